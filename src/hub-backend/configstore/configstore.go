@@ -4,6 +4,7 @@ package configstore
 import (
 	"bytes"
 	"encoding/json"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 )
@@ -48,6 +49,10 @@ func Load(filename string, v interface{}) error {
 	return nil
 }
 
+// Store writes data to a JSON file. The file is written to a temporary
+// file with a unique name first and then renamed, so it is never left
+// half-written, even if the same file is stored concurrently.
+// filename may contain subdirectories, which are created as needed.
 func Store(filename string, data interface{}) error {
 	buf := bytes.NewBuffer([]byte{})
 
@@ -59,13 +64,26 @@ func Store(filename string, data interface{}) error {
 		return err
 	}
 
-	file, err := os.Create(GetFilePath(filename))
+	path := GetFilePath(filename)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
 	if err != nil {
 		return err
 	}
-	buf.WriteTo(file)
-	file.Close()
-	return nil
+	tmpPath := tmpFile.Name()
+	_, err = tmpFile.Write(buf.Bytes())
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
 }
 
 func OpenFile(filename string) (*os.File, error) {
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	modkernel32       = syscall.NewLazyDLL("kernel32.dll")
+	procAttachConsole = modkernel32.NewProc("AttachConsole")
+)
+
+// attachParentProcess is the ATTACH_PARENT_PROCESS argument of AttachConsole.
+const attachParentProcess = uintptr(^uint32(0))
+
+// attachParentConsole makes the output of the "test" subcommand visible when
+// it is started from a command prompt. Release builds are linked as GUI
+// applications, which do not get a console of their own, so the standard
+// output and error handles are missing unless they have been redirected.
+// Handles that have been redirected (to a file or to the pipe of the
+// run_script_tests API call) are left alone.
+func attachParentConsole() {
+	stdoutMissing := syscall.Stdout == 0 || syscall.Stdout == syscall.InvalidHandle
+	stderrMissing := syscall.Stderr == 0 || syscall.Stderr == syscall.InvalidHandle
+	if !stdoutMissing && !stderrMissing {
+		return
+	}
+	if r, _, _ := procAttachConsole.Call(attachParentProcess); r == 0 {
+		// not started from a console
+		return
+	}
+	if stdoutMissing {
+		if f, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0); err == nil {
+			os.Stdout = f
+		}
+	}
+	if stderrMissing {
+		if f, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0); err == nil {
+			os.Stderr = f
+		}
+	}
+}
@@ -79,6 +79,97 @@ func (crs *ControlReferenceStore) GetIOElementByIdentifier(identifier string) *I
 	return nil
 }
 
+// GetModuleIOElements returns copies of all IOElements of a module,
+// sorted by category and name. Returns nil if the module is not loaded.
+func (crs *ControlReferenceStore) GetModuleIOElements(moduleName string) []IOElement {
+	crs.moduleDataLock.Lock()
+	defer crs.moduleDataLock.Unlock()
+
+	for name, module := range crs.modules {
+		if strings.ToLower(name) != strings.ToLower(moduleName) {
+			continue
+		}
+		ret := make([]IOElement, 0)
+		for _, category := range module {
+			for _, elem := range category {
+				ret = append(ret, *elem)
+			}
+		}
+		sort.Slice(ret, func(i, j int) bool {
+			if ret[i].Category != ret[j].Category {
+				return ret[i].Category < ret[j].Category
+			}
+			return ret[i].Name < ret[j].Name
+		})
+		return ret
+	}
+	return nil
+}
+
+// GetAllIOElements returns copies of the IOElements of all loaded modules.
+func (crs *ControlReferenceStore) GetAllIOElements() []IOElement {
+	crs.moduleDataLock.Lock()
+	defer crs.moduleDataLock.Unlock()
+
+	ret := make([]IOElement, 0)
+	for _, module := range crs.modules {
+		for _, category := range module {
+			for _, elem := range category {
+				ret = append(ret, *elem)
+			}
+		}
+	}
+	return ret
+}
+
+// AddIOElement adds an element to the store or replaces an element with the
+// same module and name. The module and category are created if necessary.
+func (crs *ControlReferenceStore) AddIOElement(elem IOElement) {
+	crs.moduleDataLock.Lock()
+	defer crs.moduleDataLock.Unlock()
+
+	module, ok := crs.modules[elem.Module]
+	if !ok {
+		module = make(IOElementCategoriesMap)
+		crs.modules[elem.Module] = module
+	}
+	for categoryName, category := range module {
+		if _, exists := category[elem.Name]; exists && categoryName != elem.Category {
+			delete(category, elem.Name)
+			if len(category) == 0 {
+				delete(module, categoryName)
+			}
+		}
+	}
+	category, ok := module[elem.Category]
+	if !ok {
+		category = make(map[string]*IOElement)
+		module[elem.Category] = category
+	}
+	category[elem.Name] = &elem
+}
+
+// RemoveIOElement removes an element that was added with AddIOElement.
+// Categories and modules that become empty are removed as well.
+func (crs *ControlReferenceStore) RemoveIOElement(moduleName string, elementName string) {
+	crs.moduleDataLock.Lock()
+	defer crs.moduleDataLock.Unlock()
+
+	module, ok := crs.modules[moduleName]
+	if !ok {
+		return
+	}
+	for categoryName, category := range module {
+		delete(category, elementName)
+		if len(category) == 0 {
+			delete(module, categoryName)
+		}
+	}
+	if len(module) == 0 {
+		delete(crs.modules, moduleName)
+	}
+}
+
 func NewControlReferenceStore(jsonAPI *jsonapi.JsonApi) *ControlReferenceStore {
 	crs := &ControlReferenceStore{
 		modules: make(map[string]IOElementCategoriesMap),
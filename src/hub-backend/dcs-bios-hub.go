@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
@@ -8,6 +9,7 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"dcs-bios.a10c.de/dcs-bios-hub/configstore"
@@ -20,6 +22,7 @@ import (
 	"dcs-bios.a10c.de/dcs-bios-hub/livedataapi"
 	"dcs-bios.a10c.de/dcs-bios-hub/luaconsole"
 	"dcs-bios.a10c.de/dcs-bios-hub/luastate"
+	"dcs-bios.a10c.de/dcs-bios-hub/luastate/netmodule"
 	"dcs-bios.a10c.de/dcs-bios-hub/pluginmanager"
 	"dcs-bios.a10c.de/dcs-bios-hub/serialconnection"
 	"dcs-bios.a10c.de/dcs-bios-hub/statusapi"
@@ -30,9 +33,26 @@ import (
 var gitSha1 string = "development build"
 var gitTag string = "development build"
 var autorunMode *bool = flag.Bool("autorun-mode", false, "Silently exit when binding TCP port 5010 fails. This prevents a message box when the program is being started by DCS but is already running.")
+var apiResponseTimeout = flag.Duration("api-response-timeout", jsonapi.DefaultResponseTimeout, "Maximum time an API call may take to send its next response before it is cancelled. 0 disables the timeout.")
+var luaCallbackTimeLimit = flag.Duration("lua-callback-time-limit", luastate.DefaultCallbackTimeLimit, "Maximum time a single call to a hub script callback may take. Callbacks that exceed the limit are disabled until the script is reloaded. 0 disables the limit.")
+var luaCommandQueueSize = flag.Int("lua-command-queue-size", luastate.DefaultCommandQueueSize, "Number of commands sent by hub scripts that can be queued before further commands are dropped.")
+var luaNetAllowInternet = flag.Bool("lua-net-allow-internet", false, "Allow the net module of hub scripts to connect to addresses on the internet. By default, only addresses on this computer and on private networks are allowed.")
 var enableIdleUpdates = flag.Bool("enable-idle-updates", false, "Send data updates to COM ports when no data has been received from the simulation for 60 ms. Can be useful for custom Lua scripts, but might break Arduino Mega 2560 panels which can get stuck in the boot loader when data is sent too early after connection.")
 
-func runHttpServer(listenURI string) error {
+// services keeps track of the goroutines started by startServices()
+// so shutdown() can wait for them to finish.
+var services sync.WaitGroup
+
+// goService runs fn in a new goroutine that is tracked by the services WaitGroup.
+func goService(fn func()) {
+	services.Add(1)
+	go func() {
+		defer services.Done()
+		fn()
+	}()
+}
+
+func runHttpServer(ctx context.Context, listenURI string) error {
 	handlerFunc := func(w http.ResponseWriter, r *http.Request) {
 		// redirect "/" to "/app/hubconfig"
 		if r.RequestURI == "/" {
@@ -49,10 +69,18 @@ func runHttpServer(listenURI string) error {
 		return err
 	}
 	go server.Serve(listenSocket)
+	goService(func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	})
 	return nil
 }
 
-func startServices() {
+// startServices starts all services of the DCS-BIOS Hub.
+// They keep running until ctx is cancelled.
+func startServices(ctx context.Context) {
 	// find out where our executable is
 	executableFilePath, err := os.Executable()
 	if err != nil {
@@ -71,7 +99,8 @@ func startServices() {
 
 	// create jsonAPI instance
 	// this is passed to the other services to make their API calls available
-	jsonAPI := jsonapi.NewJsonApi()
+	jsonAPI := jsonapi.NewJsonApi(ctx)
+	jsonAPI.SetResponseTimeout(*apiResponseTimeout)
 
 	// run a web server on port 5010
 	// the jsonAPI will be available via websockets at /api/websocket
@@ -87,7 +116,7 @@ func startServices() {
 
 	websocketapi.JsonApi = jsonAPI
 	websocketapi.AddHandler()
-	err = runHttpServer(":5010")
+	err = runHttpServer(ctx, ":5010")
 	if err != nil {
 		// already running
 		if !*autorunMode {
@@ -105,16 +134,16 @@ func startServices() {
 
 	// Lua console TCP server
 	luaConsole := luaconsole.NewServer(jsonAPI)
-	go luaConsole.Run()
+	goService(func() { luaConsole.Run(ctx) })
 
 	// connection to DCS-BIOS Lua Script via TCP port 7778
 	dcsConn := dcsconnection.New(jsonAPI)
-	go dcsConn.Run()
+	goService(func() { dcsConn.Run(ctx) })
 
 	// serial port connections
 	portManager := serialconnection.NewPortManager()
 	portManager.SetupJSONApi(jsonAPI)
-	go portManager.Run()
+	goService(func() { portManager.Run(ctx) })
 
 	// live data API endpoint
 	lda := livedataapi.NewLiveDataApi(jsonAPI)
@@ -126,25 +155,31 @@ func startServices() {
 		fmt.Printf("error: %s\n", err.Error())
 	}
 
-	// the Lua state that user-defined remapping scripts are executed in
+	// the Lua states that user-defined remapping scripts are executed in
+	luastate.SetCallbackTimeLimit(*luaCallbackTimeLimit)
+	luastate.SetCommandQueueSize(*luaCommandQueueSize)
+	netmodule.AllowPublicAddresses = *luaNetAllowInternet
+	luastate.ControlReferenceStore = cref
 	luastate.Reset(os.Stdout)
+	goService(func() { luastate.RunScriptWatcher(ctx) })
+	goService(func() { luastate.RunActivationUpdates(ctx) })
 
 	luastate.RegisterJsonApiCalls(jsonAPI)
 
 	exportDataParser := exportdataparser.NewParser(cref)
 
-	go func() {
+	goService(func() {
 		exportBuffer := exportdataparser.NewDataBuffer(cref)
 		enc := exportdataparser.NewEncoder(exportBuffer)
 		simData := exportdataparser.NewDataBuffer(cref)
 
 		luastate.ExportDataBuffer = exportBuffer
-		luastate.SimDataBuffer = simData
+		luastate.SetSimDataBuffer(simData)
 
 		for {
 			select {
 			case simData = <-exportDataParser.FrameData:
-				luastate.SimDataBuffer = simData
+				luastate.SetSimDataBuffer(simData)
 				// remap here
 				for _, v := range simData.BinaryData {
 					exportBuffer.SetUint16(v.Address, v.Data)
@@ -162,14 +197,19 @@ func startServices() {
 					portManager.Write(updatePacket)
 					lda.WriteExportData(updatePacket)
 				}
+
+			case <-ctx.Done():
+				return
 			}
 		}
-	}()
+	})
 
 	// transmit data between DCS and the serial ports
-	go func() {
+	goService(func() {
 		for {
 			select {
+			case <-ctx.Done():
+				return
 
 			case icstr := <-lda.InputCommands:
 				cmd := []byte(string(icstr) + "\n")
@@ -180,23 +220,56 @@ func startServices() {
 				dcsConn.TrySend(cmd)
 
 			case ic := <-portManager.InputCommands:
-				if !luastate.NotifyInputCallbacks(string(ic.Command)) {
+				if !luastate.NotifyInputCallbacks(string(ic.Command), ic.SourcePortName) {
 					cmd := []byte(string(ic.Command) + "\n")
 					dcsConn.TrySend(cmd)
 				}
 
+			case ic := <-luastate.InjectedCommandChannel:
+				if !luastate.NotifyInputCallbacks(ic.Command, ic.Source) {
+					cmd := []byte(ic.Command + "\n")
+					dcsConn.TrySend(cmd)
+				}
+
 			case data := <-dcsConn.ExportData:
 				for _, b := range data {
 					exportDataParser.ProcessByte(b)
 				}
 			}
 		}
-	}()
+	})
 
 	fmt.Println("ready.")
 }
 
+// shutdown stops all services in an orderly fashion:
+// the serial ports are closed and their configuration is written to disk
+// by the port manager, then the Lua state is closed once nothing
+// can call into it anymore.
+func shutdown(stopServices context.CancelFunc) {
+	fmt.Println("shutting down...")
+	stopServices()
+
+	allServicesStopped := make(chan struct{})
+	go func() {
+		services.Wait()
+		close(allServicesStopped)
+	}()
+	select {
+	case <-allServicesStopped:
+	case <-time.After(5 * time.Second):
+		fmt.Println("timed out waiting for services to stop")
+	}
+
+	luastate.Close()
+}
+
 func main() {
 	flag.Parse()
-	gui.Run(startServices)
+	if flag.Arg(0) == "test" {
+		attachParentConsole()
+		os.Exit(runTestCommand(flag.Args()[1:]))
+	}
+	ctx, stopServices := context.WithCancel(context.Background())
+	gui.Run(func() { startServices(ctx) }, func() { shutdown(stopServices) })
 }
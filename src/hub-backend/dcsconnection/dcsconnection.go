@@ -1,6 +1,7 @@
 package dcsconnection
 
 import (
+	"context"
 	"io"
 	"net"
 	"sync"
@@ -12,15 +13,25 @@ import (
 
 type ChanWriter struct {
 	targetChannel chan<- []byte
+	done          <-chan struct{}
 }
 
-func NewChanWriter(targetChannel chan<- []byte) *ChanWriter {
-	cw := &ChanWriter{targetChannel: targetChannel}
+// NewChanWriter returns a Writer that sends everything written to it to targetChannel.
+// Once done is closed, writes fail with io.ErrClosedPipe instead of blocking.
+func NewChanWriter(targetChannel chan<- []byte, done <-chan struct{}) *ChanWriter {
+	cw := &ChanWriter{targetChannel: targetChannel, done: done}
 	return cw
 }
 func (cw *ChanWriter) Write(part []byte) (n int, err error) {
-	cw.targetChannel <- part
-	return len(part), nil
+	// the caller may reuse part after Write returns
+	partCopy := make([]byte, len(part))
+	copy(partCopy, part)
+	select {
+	case cw.targetChannel <- partCopy:
+		return len(part), nil
+	case <-cw.done:
+		return 0, io.ErrClosedPipe
+	}
 }
 
 type DcsConnectionState string
@@ -70,8 +81,11 @@ func (dc *DcsConnection) TrySend(message []byte) {
 	}
 }
 
-func (dc *DcsConnection) Run() {
-	exportDataWriter := NewChanWriter(dc.ExportData)
+// Run connects to DCS and sends the data it receives to the ExportData channel.
+// It reconnects whenever the connection is lost and returns when ctx is cancelled
+// or Close() is called.
+func (dc *DcsConnection) Run(ctx context.Context) {
+	exportDataWriter := NewChanWriter(dc.ExportData, ctx.Done())
 
 	for {
 		// phase 1: establish connection
@@ -93,11 +107,13 @@ func (dc *DcsConnection) Run() {
 			select {
 			case <-dc.done:
 				return
+			case <-ctx.Done():
+				return
 			case <-time.After(1 * time.Second):
 			}
 		}
 
-		dcsConnectionClosed := make(chan struct{})
+		dcsConnectionClosed := make(chan struct{}, 1)
 		// phase 2: read data
 		go func() {
 			io.Copy(exportDataWriter, dc.conn)
@@ -105,9 +121,13 @@ func (dc *DcsConnection) Run() {
 		}()
 
 		// wait until we want to close the connection or it is closed by DCS
+		stop := false
 		select {
 		case <-dcsConnectionClosed:
 		case <-dc.done:
+			stop = true
+		case <-ctx.Done():
+			stop = true
 		}
 
 		// close the connection and update status
@@ -119,5 +139,9 @@ func (dc *DcsConnection) Run() {
 		dc.conn.Close()
 		dc.conn = nil
 		dc.mutex.Unlock()
+
+		if stop {
+			return
+		}
 	}
 }
@@ -118,6 +118,22 @@ func getHookDefinition(name string) *hookDefinition {
 			
 			
 			
+			local function encodeEnvironmentInfo(simulationRunning)
+				local info = { type = "info", environments = { "gui" }, mission = "" }
+				if simulationRunning then
+					for _, env in ipairs({ "export", "mission", "server", "config" }) do
+						local ok, result, success = pcall(net.dostring_in, env, "return 1")
+						if ok and success and result == "1" then
+							table.insert(info.environments, env)
+						end
+					end
+					local ok, mission = pcall(DCS.getMissionName)
+					if ok and mission then info.mission = tostring(mission) end
+				end
+				info.dcsVersion = tostring(_APP_VERSION or "")
+				return JSON:encode(info):gsub("\n","").."\n"
+			end
+			
 			dcsBiosLuaConsole = {}
 			
 			dcsBiosLuaConsole.host = "localhost"
@@ -126,6 +142,7 @@ func getHookDefinition(name string) *hookDefinition {
 			dcsBiosLuaConsole.state = "closed"
 			dcsBiosLuaConsole.timeClosed = 0
 			dcsBiosLuaConsole.timeOfLastSendAttempt = 0
+			dcsBiosLuaConsole.timeOfLastInfo = 0
 			
 			local function reconnect()
 				--log.write('Lua Console', log.INFO, "attempting to connect at real time "..tostring(DCS.getRealTime()))
@@ -136,6 +153,7 @@ func getHookDefinition(name string) *hookDefinition {
 				dcsBiosLuaConsole.state = "connecting"
 				dcsBiosLuaConsole.txbuf = '{"type":"ping"}\n'
 				dcsBiosLuaConsole.rxbuf = ""
+				dcsBiosLuaConsole.timeOfLastInfo = 0
 				dcsBiosLuaConsole.conn = socket.tcp()
 				dcsBiosLuaConsole.conn:settimeout(.0001)
 				dcsBiosLuaConsole.conn:connect(dcsBiosLuaConsole.host, dcsBiosLuaConsole.port)
@@ -149,6 +167,12 @@ func getHookDefinition(name string) *hookDefinition {
 					end
 				end
 				
+				-- report the available environments and the current mission
+				if dcsBiosLuaConsole.state ~= "closed" and DCS.getRealTime() - dcsBiosLuaConsole.timeOfLastInfo > 5 then
+					dcsBiosLuaConsole.timeOfLastInfo = DCS.getRealTime()
+					dcsBiosLuaConsole.txbuf = dcsBiosLuaConsole.txbuf .. encodeEnvironmentInfo(true)
+				end
+				
 				--if dcsBiosLuaConsole.txbuf == "" then
 				--	dcsBiosLuaConsole.txbuf = dcsBiosLuaConsole.txbuf .. '{"type":"ping"}\n'
 				--else
@@ -193,6 +217,7 @@ func getHookDefinition(name string) *hookDefinition {
 						local response_msg = {}
 						response_msg.type = "luaresult"
 						response_msg.name = msg.name
+						response_msg.id = msg.id
 						
 						--log.write('LuaConsole', log.INFO, "executing snippet "..msg.code.." in "..msg.luaenv)
 						
@@ -278,6 +303,7 @@ func getHookDefinition(name string) *hookDefinition {
 						local response_msg = {}
 						response_msg.type = "luaresult"
 						response_msg.name = msg.name
+						response_msg.id = msg.id
 						
 						--log.write('LuaConsole', log.INFO, "executing snippet "..msg.code.." in "..msg.luaenv)
 						
@@ -319,6 +345,14 @@ func getHookDefinition(name string) *hookDefinition {
 					if not status then
 						--log.write("Lua Console Error", log.INFO, tostring(err))
 					end
+				end,
+				["onSimulationStop"] = function()
+					-- onSimulationFrame is not called outside of missions, so send the update now
+					if dcsBiosLuaConsole.state ~= "closed" then
+						dcsBiosLuaConsole.txbuf = dcsBiosLuaConsole.txbuf .. encodeEnvironmentInfo(false)
+						dcsBiosLuaConsole.timeOfLastInfo = DCS.getRealTime()
+						pcall(step)
+					end
 				end
 			})
 			
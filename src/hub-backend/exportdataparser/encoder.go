@@ -18,12 +18,18 @@ func byteSliceFromUint16(value uint16) []byte {
 	return x
 }
 
+// Update returns the data that has changed since the last call and
+// clears the dirty flags. The data buffer is locked while the update is
+// assembled, so it can be written from other goroutines in the meantime.
 func (enc *encoder) Update() []byte {
-	enc.DataBuffer.SetFFFEDirty()
+	dataBuffer := enc.DataBuffer
+	dataBuffer.lock.Lock()
+	defer dataBuffer.lock.Unlock()
+
+	dataBuffer.setFFFEDirty()
 
 	updatePacket := make([]byte, 0)
 
-	dataBuffer := enc.DataBuffer
 	binData := dataBuffer.BinaryData
 
 	if len(binData) > 0 {
@@ -63,7 +69,7 @@ func (enc *encoder) Update() []byte {
 				a := lastWriteDataAddress + 2
 				for a <= entry.Address {
 					writeLength += 2
-					writeData = append(writeData, byteSliceFromUint16(enc.DataBuffer.GetValueAtAddress(a))...)
+					writeData = append(writeData, byteSliceFromUint16(dataBuffer.valueAtAddress(a))...)
 					lastWriteDataAddress = a
 					a += 2
 				}
@@ -21,10 +21,14 @@ type DataWord struct {
 	Dirty   bool
 }
 
+// DataBuffer may be read and written from several goroutines, e.g. by
+// the callbacks of timers and network connections of hub scripts.
+// BinaryData must only be accessed directly while no other goroutine
+// has access to the buffer.
 type DataBuffer struct {
 	controlReferenceStore *controlreference.ControlReferenceStore
 	BinaryData            []DataWord
-	lock                  sync.Mutex
+	lock                  sync.Mutex // protects BinaryData
 }
 
 func NewDataBuffer(crefstore *controlreference.ControlReferenceStore) *DataBuffer {
@@ -33,22 +37,43 @@ func NewDataBuffer(crefstore *controlreference.ControlReferenceStore) *DataBuffe
 	}
 }
 
-func (db *DataBuffer) setBytes(address uint16, data []byte) {
+// SetBytes writes data to the buffer starting at the (even) address.
+// If data has an odd length, the high byte of the last word is not changed.
+func (db *DataBuffer) SetBytes(address uint16, data []byte) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
 	i := 0
 	addr := address
 	for i < len(data) {
-		word := db.GetValueAtAddress(addr)
+		word := db.valueAtAddress(addr)
 		word = (word & 0xFF00) | uint16(data[i])
 		i++
 		if i < len(data) {
 			word = (word & 0x00FF) | (uint16(data[i]) << 8)
 		}
 		i++
-		db.SetUint16(addr, word)
+		db.setUint16(addr, word)
 		addr += 2
 	}
 }
 
+// GetBytes returns length bytes from the buffer starting at the (even) address.
+func (db *DataBuffer) GetBytes(address uint16, length uint16) []byte {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	data := make([]byte, 0, length)
+	addr := address
+	for uint16(len(data)) < length {
+		word := db.valueAtAddress(addr)
+		data = append(data, byte(word&0x00FF))
+		if uint16(len(data)) < length {
+			data = append(data, byte(word>>8))
+		}
+		addr += 2
+	}
+	return data
+}
+
 func (db *DataBuffer) GetIntegerValue(valueIdentifier string) int {
 	element := db.controlReferenceStore.GetIOElementByIdentifier(valueIdentifier)
 	if element == nil {
@@ -70,12 +95,14 @@ func (db *DataBuffer) GetCStringValue(valueIdentifier string) string {
 	}
 	for _, output := range element.Outputs {
 		if output.Type == "string" {
+			db.lock.Lock()
+			defer db.lock.Unlock()
 			data := make([]byte, 0)
 			bytesLeft := output.MaxLength
 			addr := output.Address
 
 			for bytesLeft > 0 {
-				word := db.GetValueAtAddress(addr)
+				word := db.valueAtAddress(addr)
 				thisByte := byte(word & 0x00FF)
 				if thisByte == 0 {
 					break
@@ -115,7 +142,7 @@ func (db *DataBuffer) SetCStringValue(valueIdentifier string, value string) bool
 				// fill up with spaces up to max length
 				newBytes = append(newBytes, 32)
 			}
-			db.setBytes(output.Address, newBytes)
+			db.SetBytes(output.Address, newBytes)
 			return true
 		}
 	}
@@ -132,7 +159,9 @@ func (db *DataBuffer) SetIntegerValue(valueIdentifier string, value int) bool {
 			if value < 0 || uint16(value) > output.MaxValue {
 				return false
 			}
-			currentWord := db.GetValueAtAddress(output.Address)
+			db.lock.Lock()
+			defer db.lock.Unlock()
+			currentWord := db.valueAtAddress(output.Address)
 			//			fmt.Printf("currentWord: %v ", currentWord)
 			// clear all bits
 			var mask uint16 = 0x0001
@@ -147,7 +176,7 @@ func (db *DataBuffer) SetIntegerValue(valueIdentifier string, value int) bool {
 			currentWord |= (uint16(value) << output.ShiftBy)
 			//			fmt.Printf("newWord: %v \n", currentWord)
 
-			db.SetUint16(output.Address, currentWord)
+			db.setUint16(output.Address, currentWord)
 
 			return true
 		}
@@ -156,17 +185,31 @@ func (db *DataBuffer) SetIntegerValue(valueIdentifier string, value int) bool {
 }
 
 func (db *DataBuffer) SetFFFEDirty() {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.setFFFEDirty()
+}
+
+// setFFFEDirty implements SetFFFEDirty. The caller must hold db.lock.
+func (db *DataBuffer) setFFFEDirty() {
 	for i := range db.BinaryData {
 		if db.BinaryData[i].Address == 0xFFFE {
 			db.BinaryData[i].Dirty = true
 			return
 		}
 	}
-	db.SetUint16(0xFFFE, 0)
+	db.setUint16(0xFFFE, 0)
 }
 
 // GetValueAtAddress returns the value for an entry at the given address, or 0x0000 if no entry is found.
 func (db *DataBuffer) GetValueAtAddress(address uint16) uint16 {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.valueAtAddress(address)
+}
+
+// valueAtAddress implements GetValueAtAddress. The caller must hold db.lock.
+func (db *DataBuffer) valueAtAddress(address uint16) uint16 {
 	for i := range db.BinaryData {
 		if db.BinaryData[i].Address == address {
 			return db.BinaryData[i].Data
@@ -175,10 +218,30 @@ func (db *DataBuffer) GetValueAtAddress(address uint16) uint16 {
 	return 0
 }
 
+// IsDirty returns true if any of the 16-bit words in the range of length bytes
+// starting at address has been changed since the dirty flags were last cleared.
+func (db *DataBuffer) IsDirty(address uint16, length uint16) bool {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	end := uint32(address) + uint32(length)
+	for i := range db.BinaryData {
+		addr := uint32(db.BinaryData[i].Address)
+		if addr+2 > uint32(address) && addr < end && db.BinaryData[i].Dirty {
+			return true
+		}
+	}
+	return false
+}
+
 // SetUint16 sets a 16-bit value in the data buffer at the given address and marks it as dirty.
 func (db *DataBuffer) SetUint16(address uint16, value uint16) {
 	db.lock.Lock()
 	defer db.lock.Unlock()
+	db.setUint16(address, value)
+}
+
+// setUint16 implements SetUint16. The caller must hold db.lock.
+func (db *DataBuffer) setUint16(address uint16, value uint16) {
 	var insertBefore int = len(db.BinaryData)
 	for i := range db.BinaryData {
 		if db.BinaryData[i].Address == address {
@@ -206,6 +269,16 @@ func (db *DataBuffer) SetUint16(address uint16, value uint16) {
 	db.BinaryData[insertBefore].Dirty = true
 }
 
+// SetBits replaces the bits selected by mask in the 16-bit value at the given
+// address with the corresponding bits of value. Other goroutines cannot
+// change the word between reading and writing it.
+func (db *DataBuffer) SetBits(address uint16, mask uint16, value uint16) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	word := db.valueAtAddress(address)
+	db.setUint16(address, (word&^mask)|(value&mask))
+}
+
 // Copy returns a new data buffer containing the same data and dirty bits.
 func (db *DataBuffer) Copy() *DataBuffer {
 	db.lock.Lock()
@@ -11,7 +11,6 @@ require (
 	github.com/getlantern/systray v0.0.0-20191102120558-baeca33b8639
 	github.com/go-stack/stack v1.8.0 // indirect
 	github.com/gorilla/websocket v1.4.0
-	github.com/hidez8891/shm v0.0.0-20171027150025-da172d176d6b
 	github.com/nubix-io/gluabit32 v0.0.0-20190708203852-cb1e79982fc9
 	github.com/oxtoacart/bpool v0.0.0-20150712133111-4e1c5567d7c2 // indirect
 	github.com/skratchdot/open-golang v0.0.0-20190104022628-a2dfa6d0dab6
@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"dcs-bios.a10c.de/dcs-bios-hub/icon"
@@ -29,6 +30,14 @@ func IsLuaConsoleEnabled() bool {
 	return atomic.LoadUint32(&luaConsoleEnabled) == 1
 }
 
+// remoteLuaConfirmationEnabled is 1 if snippets sent to the Lua Console
+// from other computers have to be confirmed. It is enabled by default.
+var remoteLuaConfirmationEnabled uint32 = 1
+
+func IsRemoteLuaConfirmationEnabled() bool {
+	return atomic.LoadUint32(&remoteLuaConfirmationEnabled) == 1
+}
+
 func Quit() {
 	systray.Quit()
 }
@@ -46,9 +55,36 @@ func ErrorMsgBox(msg string, title string) {
 		uintptr(MB_OK|MB_ICONERROR))
 }
 
+// ConfirmMsgBox asks a yes/no question in a message box
+// and returns true if the user answered "yes". The message box
+// closes itself after timeout, which counts as "no".
+func ConfirmMsgBox(msg string, title string, timeout time.Duration) bool {
+	var mod = syscall.NewLazyDLL("user32.dll")
+	// MessageBoxTimeoutW is not documented, but has been
+	// available with the same signature since Windows XP
+	var proc = mod.NewProc("MessageBoxTimeoutW")
+	var MB_YESNO = 0x00000004
+	var MB_ICONWARNING = 0x00000030
+	var MB_DEFBUTTON2 = 0x00000100
+	var MB_SYSTEMMODAL = 0x00001000
+	var MB_SETFOREGROUND = 0x00010000
+	var IDYES uintptr = 6
+
+	ret, _, _ := proc.Call(0,
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(msg))),
+		uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(title))),
+		uintptr(MB_YESNO|MB_ICONWARNING|MB_DEFBUTTON2|MB_SYSTEMMODAL|MB_SETFOREGROUND),
+		0,
+		uintptr(timeout/time.Millisecond))
+	return ret == IDYES
+}
+
 // Run displays the GUI. Needs to be called directly
 // from main() before any goroutines are started.
-func Run(onReady func()) {
+// onExit is called when the user quits via the tray icon
+// or the process receives SIGINT or SIGTERM. Run returns
+// after onExit has returned.
+func Run(onReady func(), onExit func()) {
 	initGui := func() {
 		systray.SetIcon(icon.IconData)
 		systray.SetTitle("DCS-BIOS Hub")
@@ -60,15 +96,17 @@ func Run(onReady func()) {
 		systray.AddSeparator()
 		mToggleExternalAccess := systray.AddMenuItem("Enable access over the network", "Allow the web interface and API to be accessed over the network.")
 		mLuaConsoleEnabled := systray.AddMenuItem("Enable Lua Console", "Enable the Lua console. Warning: this allows anyone with access to the web interface to execute arbitrary code on your machine!")
+		mConfirmRemoteLua := systray.AddMenuItem("Confirm Lua snippets from the network", "Ask before executing Lua Console snippets that were sent from another computer.")
+		mConfirmRemoteLua.Check()
 		systray.AddSeparator()
 		mQuit := systray.AddMenuItem("Quit", "Quit")
 
 		go func() {
-			// handle SIGINT so we gracefully exit
+			// handle SIGINT and SIGTERM so we gracefully exit
 			// on Ctrl+C in case this is compiled
 			// and run as a console application during development
 			sigintChannel := make(chan os.Signal, 1)
-			signal.Notify(sigintChannel, os.Interrupt)
+			signal.Notify(sigintChannel, os.Interrupt, syscall.SIGTERM)
 			go func() {
 				<-sigintChannel
 				systray.Quit()
@@ -105,6 +143,14 @@ func Run(onReady func()) {
 					statusapi.WithStatusInfoDo(func(si *statusapi.StatusInfo) {
 						si.IsLuaConsoleEnabled = mLuaConsoleEnabled.Checked()
 					})
+				case <-mConfirmRemoteLua.ClickedCh:
+					if mConfirmRemoteLua.Checked() {
+						mConfirmRemoteLua.Uncheck()
+						atomic.StoreUint32(&remoteLuaConfirmationEnabled, 0)
+					} else {
+						mConfirmRemoteLua.Check()
+						atomic.StoreUint32(&remoteLuaConfirmationEnabled, 1)
+					}
 				case <-mQuit.ClickedCh:
 					systray.Quit()
 					return
@@ -113,7 +159,5 @@ func Run(onReady func()) {
 		}()
 	}
 
-	onExit := func() {
-	}
 	systray.Run(initGui, onExit)
 }
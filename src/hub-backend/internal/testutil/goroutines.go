@@ -0,0 +1,23 @@
+// Package testutil provides helpers for the tests of the other packages.
+package testutil
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+// WaitForGoroutines fails the test if the number of goroutines does not
+// return to base within a second.
+func WaitForGoroutines(t *testing.T, base int) {
+	t.Helper()
+	deadline := time.Now().Add(1 * time.Second)
+	for runtime.NumGoroutine() > base {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			n := runtime.Stack(buf, true)
+			t.Fatalf("%d goroutines are still running, expected %d:\n%s", runtime.NumGoroutine(), base, buf[:n])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -12,8 +12,16 @@
 // the connection (i.e. the followupMessage channel is closed by the client
 // or the responseMessage channel is closed by the server).
 //
+// A handler function can optionally accept a context.Context as its first
+// parameter. That context is cancelled when the message exchange stops or
+// when the context that was passed to NewJsonApi() is cancelled, so
+// long-running handlers should return when it is done.
+//
 // This model maps to web sockets, but can also be used via a REST API
-// for API calls that close their responseData channel after one message.
+// for API calls that close their responseData channel after a finite number
+// of messages. API calls that keep sending messages until the client goes away
+// are registered with RegisterStreamingApiCall() so that the REST API can
+// serve them as a stream of Server-Sent Events instead.
 //
 // To understand the dynamic JSON decoding going on here, refer to:
 // https://eagain.net/articles/go-json-kind/
@@ -21,10 +29,15 @@
 package jsonapi
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
 )
 
 type JsonMessageEnvelope struct {
@@ -40,6 +53,9 @@ type SuccessResult struct {
 
 type ErrorResult struct {
 	Message string `json:"message"`
+	// Code is an optional HTTP status code that the REST API will use
+	// when responding with this error. If it is zero, 500 is used.
+	Code int `json:"code,omitempty"`
 }
 
 type ProgressResult struct {
@@ -47,18 +63,41 @@ type ProgressResult struct {
 }
 
 type JsonApi struct {
+	ctx                 context.Context
 	dataStructFactories map[string]func() interface{}
 
 	handlerFunctions map[string]interface{}
+	streamingCalls   map[string]bool
+	callTimeouts     map[string]time.Duration
 	msgtypeToGoType  map[string]reflect.Type
 	goTypeToMsgtype  map[reflect.Type]string
+	responseTimeout  time.Duration
+	lock             sync.RWMutex // protects the maps above and responseTimeout
+	metrics          ApiMetrics
+	metricsLock      sync.Mutex
+}
+
+// DefaultResponseTimeout is the response timeout of a new JsonApi instance.
+const DefaultResponseTimeout = 60 * time.Second
+
+// SetResponseTimeout sets how long a handler of a non-streaming API call
+// may take to send its next response or close its response channel.
+// When the timeout expires, the client receives an ErrorResult and
+// the context of the API call is cancelled.
+// A timeout of zero disables the timeout.
+// API calls registered with RegisterApiCallWithTimeout keep their own timeout.
+func (api *JsonApi) SetResponseTimeout(timeout time.Duration) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	api.responseTimeout = timeout
 }
 
 func (api *JsonApi) RegisterType(msgtype string, typExamle interface{}) {
 	v := reflect.ValueOf(typExamle)
 	var typ = v.Type()
-	// TODO: locking
 
+	api.lock.Lock()
+	defer api.lock.Unlock()
 	api.msgtypeToGoType[msgtype] = typ
 	api.goTypeToMsgtype[typ] = msgtype
 }
@@ -70,22 +109,86 @@ func (api *JsonApi) RegisterApiCall(msgtype string, handlerFunc interface{}) err
 	if k != reflect.Func {
 		return errors.New("jsonapi.RegisterApiCall(): handlerFunc must be a function")
 	}
-	if t.NumIn() != 3 {
+	firstArg := 0
+	if t.NumIn() == 4 {
+		if t.In(0) != contextType {
+			return errors.New("jsonapi.RegisterApiCall(): if handlerFunc accepts 4 parameters, the first one must be a context.Context")
+		}
+		firstArg = 1
+	} else if t.NumIn() != 3 {
 		return errors.New("jsonapi.RegisterApiCall(): handlerFunc must accept 3 parameters")
 	}
 	// check channel directions
-	responseChType := t.In(1)
+	responseChType := t.In(firstArg + 1)
 	if responseChType.Kind() != reflect.Chan || responseChType.ChanDir() != reflect.SendDir {
 		return errors.New("jsonapi.RegisterApiCall(): first parameter of handlerFunc (response channel) must be a send-only channel")
 	}
-	followupChType := t.In(2)
+	followupChType := t.In(firstArg + 2)
 	if followupChType.Kind() != reflect.Chan || followupChType.ChanDir() != reflect.RecvDir {
 		return errors.New("jsonapi.RegisterApiCall(): second parameter of handlerFunc (followup message channel) must be a receive-only channel")
 	}
+	api.lock.Lock()
+	defer api.lock.Unlock()
 	api.handlerFunctions[msgtype] = handlerFunc
+	delete(api.callTimeouts, msgtype)
 	return nil
 }
 
+// RegisterApiCallWithTimeout registers an API call like RegisterApiCall, but
+// uses timeout instead of the response timeout set with SetResponseTimeout.
+// A timeout of zero disables the timeout for this API call, which is meant
+// for handlers that may legitimately take a long time to send a response.
+func (api *JsonApi) RegisterApiCallWithTimeout(msgtype string, handlerFunc interface{}, timeout time.Duration) error {
+	if err := api.RegisterApiCall(msgtype, handlerFunc); err != nil {
+		return err
+	}
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	api.callTimeouts[msgtype] = timeout
+	return nil
+}
+
+// RegisterStreamingApiCall registers an API call like RegisterApiCall, but
+// marks it as streaming. A streaming API call keeps sending responses until
+// the client closes the followup message channel, so it cannot be answered
+// with a single REST response.
+func (api *JsonApi) RegisterStreamingApiCall(msgtype string, handlerFunc interface{}) error {
+	if err := api.RegisterApiCall(msgtype, handlerFunc); err != nil {
+		return err
+	}
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	api.streamingCalls[msgtype] = true
+	return nil
+}
+
+// HasApiCall returns true if a handler function has been registered for msgtype.
+func (api *JsonApi) HasApiCall(msgtype string) bool {
+	api.lock.RLock()
+	defer api.lock.RUnlock()
+	_, ok := api.handlerFunctions[msgtype]
+	return ok
+}
+
+// IsStreamingApiCall returns true if msgtype has been registered with RegisterStreamingApiCall.
+func (api *JsonApi) IsStreamingApiCall(msgtype string) bool {
+	api.lock.RLock()
+	defer api.lock.RUnlock()
+	return api.streamingCalls[msgtype]
+}
+
+// ApiCallNames returns the sorted list of msgtypes that have a handler function.
+func (api *JsonApi) ApiCallNames() []string {
+	api.lock.RLock()
+	defer api.lock.RUnlock()
+	names := make([]string, 0, len(api.handlerFunctions))
+	for msgtype := range api.handlerFunctions {
+		names = append(names, msgtype)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (api *JsonApi) decodeJson(envelopeJson []byte) (*JsonMessageEnvelope, error) {
 	var raw json.RawMessage
 	var err error
@@ -97,7 +200,9 @@ func (api *JsonApi) decodeJson(envelopeJson []byte) (*JsonMessageEnvelope, error
 		return nil, errors.New("jsonapi: decodeJson: invalid envelope")
 	}
 
+	api.lock.RLock()
 	typ, ok := api.msgtypeToGoType[env.DataType]
+	api.lock.RUnlock()
 	if !ok {
 		return nil, errors.New("jsonapi: decodeJson: unknown msgtype: " + env.DataType)
 	}
@@ -120,7 +225,9 @@ func (api *JsonApi) encodeJson(data interface{}) ([]byte, error) {
 	// 	v = v.Elem()
 	// }
 	// fmt.Printf("encodeJson: looking up: %v\n", t)
+	api.lock.RLock()
 	msgtype, ok := api.goTypeToMsgtype[t]
+	api.lock.RUnlock()
 	if !ok {
 		return nil, errors.New("jsonapi.encodeJson(): unknown type:" + t.Name())
 	}
@@ -134,16 +241,33 @@ func (api *JsonApi) encodeJson(data interface{}) ([]byte, error) {
 	return ret, err
 }
 
-func NewJsonApi() *JsonApi {
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// NewJsonApi creates a new JsonApi instance. When ctx is cancelled,
+// the contexts of all running API calls are cancelled as well.
+func NewJsonApi(ctx context.Context) *JsonApi {
 	api := &JsonApi{
+		ctx:                 ctx,
 		dataStructFactories: make(map[string]func() interface{}),
 		handlerFunctions:    make(map[string]interface{}),
+		streamingCalls:      make(map[string]bool),
+		callTimeouts:        make(map[string]time.Duration),
 		msgtypeToGoType:     make(map[string]reflect.Type),
 		goTypeToMsgtype:     make(map[reflect.Type]string),
+		responseTimeout:     DefaultResponseTimeout,
+		metrics:             newApiMetrics(),
 	}
 	api.RegisterType("success", SuccessResult{})
 	api.RegisterType("error", ErrorResult{})
 	api.RegisterType("Progress", ProgressResult{})
+
+	api.RegisterType("describe_api", DescribeApiRequest{})
+	api.RegisterApiCall("describe_api", api.handleDescribeApiRequest)
+	api.RegisterType("api_description", ApiDescription{})
+
+	api.RegisterType("get_api_metrics", GetApiMetricsRequest{})
+	api.RegisterApiCall("get_api_metrics", api.handleGetApiMetricsRequest)
+	api.RegisterType("api_metrics", ApiMetrics{})
 	return api
 }
 
@@ -152,7 +276,25 @@ type ApiResponse struct {
 	IsUTF8 bool
 }
 
+// remoteAddrKey is the context key for the address of the client of an API call.
+type remoteAddrKey struct{}
+
+// RemoteAddr returns the network address of the client that started the API
+// call, as passed to HandleRemoteApiCall. It returns an empty string for
+// calls that were started with HandleApiCall.
+func RemoteAddr(ctx context.Context) string {
+	addr, _ := ctx.Value(remoteAddrKey{}).(string)
+	return addr
+}
+
 func (api *JsonApi) HandleApiCall(envelopeJsonData []byte, followupMessagesJson chan []byte) (responseJsonChannel chan ApiResponse, err error) {
+	return api.HandleRemoteApiCall("", envelopeJsonData, followupMessagesJson)
+}
+
+// HandleRemoteApiCall works like HandleApiCall, but makes the network address
+// of the client (such as http.Request.RemoteAddr) available to the handler
+// function through RemoteAddr.
+func (api *JsonApi) HandleRemoteApiCall(remoteAddr string, envelopeJsonData []byte, followupMessagesJson chan []byte) (responseJsonChannel chan ApiResponse, err error) {
 	responseJsonChannel = make(chan ApiResponse)
 
 	// decode message
@@ -162,47 +304,154 @@ func (api *JsonApi) HandleApiCall(envelopeJsonData []byte, followupMessagesJson
 		return responseJsonChannel, err
 	}
 
+	api.lock.RLock()
 	handlerFunc, ok := api.handlerFunctions[envelope.DataType]
+	api.lock.RUnlock()
 	if !ok {
 		close(responseJsonChannel)
 		return responseJsonChannel, errors.New("jsonapi: HandleApiCall: no handlerFunc for message type " + envelope.DataType)
 	}
-	// we know that handlerFunc expects 3 parameters and has Kind reflect.Func
+	// we know that handlerFunc expects 3 or 4 parameters and has Kind reflect.Func
 	// assert that the first argument type matches the type of the inital message
 	v := reflect.ValueOf(handlerFunc)
 	t := v.Type()
+	takesContext := t.NumIn() == 4
 	firstArgType := t.In(0)
+	if takesContext {
+		firstArgType = t.In(1)
+	}
 	if !reflect.TypeOf(envelope.Data).AssignableTo(firstArgType) {
 		close(responseJsonChannel)
 		return responseJsonChannel, errors.New("jsonapi: HandleApiCall: initial message type not assignable to first argument of handler function")
 	}
 
+	msgtype := envelope.DataType
+	api.lock.RLock()
+	responseTimeout := api.responseTimeout
+	if timeout, ok := api.callTimeouts[msgtype]; ok {
+		responseTimeout = timeout
+	}
+	if api.streamingCalls[msgtype] {
+		responseTimeout = 0
+	}
+	api.lock.RUnlock()
+
+	callCtx, cancelCall := context.WithCancel(context.WithValue(api.ctx, remoteAddrKey{}, remoteAddr))
 	followupChannel := make(chan interface{})
 	responseChannel := make(chan interface{})
-	// next: call handlerFunc(envelope.Data, responseChannel, followupChannel) via reflect
+	// next: call handlerFunc([callCtx,] envelope.Data, responseChannel, followupChannel) via reflect
 	argv := []reflect.Value{reflect.ValueOf(envelope.Data), reflect.ValueOf(responseChannel), reflect.ValueOf(followupChannel)}
-	go reflect.ValueOf(handlerFunc).Call(argv)
+	if takesContext {
+		argv = append([]reflect.Value{reflect.ValueOf(callCtx)}, argv...)
+	}
+	// handlerDone receives the value recovered from a panic in the handler function,
+	// or nil if the handler function returned normally.
+	handlerDone := make(chan interface{}, 1)
+	api.callStarted(msgtype)
+	go func() {
+		defer api.callFinished(msgtype)
+		defer func() {
+			r := recover()
+			if r != nil {
+				fmt.Printf("jsonapi: handler for %s panicked: %v\n%s", msgtype, r, debug.Stack())
+				api.countPanic(msgtype)
+			}
+			handlerDone <- r
+		}()
+		v.Call(argv)
+	}()
 
 	go func() {
-		for response := range responseChannel {
+		defer cancelCall()
+		defer close(responseJsonChannel)
 
-			if binaryData, ok := response.(BinaryData); ok {
-				responseJsonChannel <- ApiResponse{binaryData, false}
-			} else {
+		// once we stop forwarding responses, keep receiving them until the
+		// response channel is closed, so neither the handler nor a goroutine
+		// it started blocks on it
+		defer func() {
+			go func() {
+				for range responseChannel {
+				}
+			}()
+		}()
 
-				data, err := api.encodeJson(response)
-				if err == nil {
-					// if we could serialize the message, send it out
-					responseJsonChannel <- ApiResponse{data, true}
-				} else {
+		sendError := func(errorResult ErrorResult) {
+			apiResponse, _ := api.encodeResponse(errorResult)
+			select {
+			case responseJsonChannel <- apiResponse:
+			case <-callCtx.Done():
+			}
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if responseTimeout > 0 {
+			timer = time.NewTimer(responseTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		for {
+			select {
+			case response, ok := <-responseChannel:
+				if !ok {
+					// A panicking handler usually closes its response channel in a
+					// deferred call before the panic is recovered, so give it a
+					// moment to report the panic.
+					if handlerDone != nil {
+						select {
+						case r := <-handlerDone:
+							if r != nil {
+								sendError(panicErrorResult(msgtype, r))
+							}
+						case <-time.After(panicGracePeriod):
+						}
+					}
+					return
+				}
+				apiResponse, err := api.encodeResponse(response)
+				if err != nil {
 					fmt.Printf("error serializing response: %s\n", err.Error())
+					continue
+				}
+				select {
+				case responseJsonChannel <- apiResponse:
+				case <-callCtx.Done():
+					return
+				}
+				if timer != nil {
+					if !timer.Stop() {
+						<-timer.C
+					}
+					timer.Reset(responseTimeout)
 				}
+
+			case r := <-handlerDone:
+				// the handler may have returned while a goroutine it
+				// started keeps sending responses, so only stop on panics
+				handlerDone = nil
+				if r != nil {
+					sendError(panicErrorResult(msgtype, r))
+					return
+				}
+
+			case <-timeout:
+				api.countTimeout(msgtype)
+				sendError(ErrorResult{
+					Message: fmt.Sprintf("API call %s timed out after %v", msgtype, responseTimeout),
+					Code:    504,
+				})
+				return
+
+			case <-callCtx.Done():
+				// the client has gone away or the hub is shutting down
+				return
 			}
 		}
-		close(responseJsonChannel)
 	}()
 	// transport followup messages
 	go func() {
+		defer cancelCall()
 		for followupData := range followupMessagesJson {
 			envelope, err := api.decodeJson(followupData)
 
@@ -210,10 +459,36 @@ func (api *JsonApi) HandleApiCall(envelopeJsonData []byte, followupMessagesJson
 				fmt.Printf("jsonapi: could not decode followup message: %v\n", err)
 				continue
 			}
-			followupChannel <- envelope.Data
+			select {
+			case followupChannel <- envelope.Data:
+			case <-callCtx.Done():
+				// the handler is gone, discard the message
+			}
 		}
 		close(followupChannel)
 	}()
 
 	return responseJsonChannel, nil
 }
+
+func (api *JsonApi) encodeResponse(response interface{}) (ApiResponse, error) {
+	if binaryData, ok := response.(BinaryData); ok {
+		return ApiResponse{binaryData, false}, nil
+	}
+	data, err := api.encodeJson(response)
+	if err != nil {
+		return ApiResponse{}, err
+	}
+	return ApiResponse{data, true}, nil
+}
+
+// panicGracePeriod is how long to wait for a handler function to report
+// a panic after it has closed its response channel.
+const panicGracePeriod = 50 * time.Millisecond
+
+func panicErrorResult(msgtype string, r interface{}) ErrorResult {
+	return ErrorResult{
+		Message: fmt.Sprintf("internal error while handling %s: %v", msgtype, r),
+		Code:    500,
+	}
+}
@@ -0,0 +1,141 @@
+package jsonapi
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"dcs-bios.a10c.de/dcs-bios-hub/internal/testutil"
+)
+
+type testStreamRequest struct{}
+
+// streamUntilDone is a streaming handler that sends a response
+// every millisecond until its context is cancelled.
+func streamUntilDone(ctx context.Context, req *testStreamRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+	for {
+		select {
+		case responseCh <- SuccessResult{Message: "tick"}:
+		case <-ctx.Done():
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newTestApi(ctx context.Context) *JsonApi {
+	api := NewJsonApi(ctx)
+	api.RegisterType("test_stream", testStreamRequest{})
+	api.RegisterStreamingApiCall("test_stream", streamUntilDone)
+	return api
+}
+
+func TestClosingFollowupChannelStopsApiCall(t *testing.T) {
+	base := runtime.NumGoroutine()
+	api := newTestApi(context.Background())
+
+	followup := make(chan []byte)
+	responses, err := api.HandleApiCall([]byte(`{"datatype": "test_stream", "data": {}}`), followup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-responses
+	close(followup)
+	for range responses {
+	}
+	testutil.WaitForGoroutines(t, base)
+}
+
+func TestCancellingApiContextStopsApiCall(t *testing.T) {
+	base := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	api := newTestApi(ctx)
+
+	followup := make(chan []byte)
+	responses, err := api.HandleApiCall([]byte(`{"datatype": "test_stream", "data": {}}`), followup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-responses
+	cancel()
+	for range responses {
+	}
+	close(followup)
+	testutil.WaitForGoroutines(t, base)
+}
+
+func TestAbandonedResponseChannelDoesNotBlockHandler(t *testing.T) {
+	base := runtime.NumGoroutine()
+	api := newTestApi(context.Background())
+
+	// the client goes away without reading any further responses
+	followup := make(chan []byte)
+	_, err := api.HandleApiCall([]byte(`{"datatype": "test_stream", "data": {}}`), followup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(followup)
+	testutil.WaitForGoroutines(t, base)
+}
+
+type testBackgroundRequest struct{}
+
+// respondInBackground returns immediately and leaves a goroutine
+// that sends the responses and closes the response channel.
+func respondInBackground(req *testBackgroundRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	go func() {
+		defer close(responseCh)
+		for i := 0; i < 3; i++ {
+			responseCh <- SuccessResult{Message: "done"}
+		}
+	}()
+}
+
+func TestGoroutineOfReturnedHandlerDoesNotBlock(t *testing.T) {
+	base := runtime.NumGoroutine()
+	api := NewJsonApi(context.Background())
+	api.RegisterType("test_background", testBackgroundRequest{})
+	api.RegisterApiCall("test_background", respondInBackground)
+
+	// the client goes away before reading the responses
+	followup := make(chan []byte)
+	_, err := api.HandleApiCall([]byte(`{"datatype": "test_background", "data": {}}`), followup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(followup)
+	testutil.WaitForGoroutines(t, base)
+}
+
+type testSlowRequest struct{}
+
+// respondSlowly sends a single response after 50 milliseconds.
+func respondSlowly(req *testSlowRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+	time.Sleep(50 * time.Millisecond)
+	responseCh <- SuccessResult{Message: "done"}
+}
+
+func TestApiCallWithoutTimeoutIsNotCancelled(t *testing.T) {
+	api := NewJsonApi(context.Background())
+	api.SetResponseTimeout(10 * time.Millisecond)
+	api.RegisterType("test_slow", testSlowRequest{})
+	api.RegisterApiCallWithTimeout("test_slow", respondSlowly, 0)
+
+	followup := make(chan []byte)
+	defer close(followup)
+	responses, err := api.HandleApiCall([]byte(`{"datatype": "test_slow", "data": {}}`), followup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received []string
+	for response := range responses {
+		received = append(received, string(response.Data))
+	}
+	if len(received) != 1 || !strings.Contains(received[0], `"success"`) {
+		t.Fatalf("expected a single success response, got %v", received)
+	}
+}
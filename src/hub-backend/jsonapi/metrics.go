@@ -0,0 +1,73 @@
+package jsonapi
+
+// ApiMetrics counts API calls per msgtype.
+type ApiMetrics struct {
+	ActiveCalls map[string]int `json:"activeCalls"` // calls whose handler function has not returned yet
+	TotalCalls  map[string]int `json:"totalCalls"`  // calls since the hub was started
+	Panics      map[string]int `json:"panics"`      // handler functions that panicked
+	Timeouts    map[string]int `json:"timeouts"`    // calls that exceeded the response timeout
+}
+
+func newApiMetrics() ApiMetrics {
+	return ApiMetrics{
+		ActiveCalls: make(map[string]int),
+		TotalCalls:  make(map[string]int),
+		Panics:      make(map[string]int),
+		Timeouts:    make(map[string]int),
+	}
+}
+
+func copyCounts(m map[string]int) map[string]int {
+	ret := make(map[string]int, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
+
+// Metrics returns a snapshot of the API call metrics.
+func (api *JsonApi) Metrics() ApiMetrics {
+	api.metricsLock.Lock()
+	defer api.metricsLock.Unlock()
+	return ApiMetrics{
+		ActiveCalls: copyCounts(api.metrics.ActiveCalls),
+		TotalCalls:  copyCounts(api.metrics.TotalCalls),
+		Panics:      copyCounts(api.metrics.Panics),
+		Timeouts:    copyCounts(api.metrics.Timeouts),
+	}
+}
+
+func (api *JsonApi) callStarted(msgtype string) {
+	api.metricsLock.Lock()
+	defer api.metricsLock.Unlock()
+	api.metrics.ActiveCalls[msgtype]++
+	api.metrics.TotalCalls[msgtype]++
+}
+
+func (api *JsonApi) callFinished(msgtype string) {
+	api.metricsLock.Lock()
+	defer api.metricsLock.Unlock()
+	api.metrics.ActiveCalls[msgtype]--
+	if api.metrics.ActiveCalls[msgtype] == 0 {
+		delete(api.metrics.ActiveCalls, msgtype)
+	}
+}
+
+func (api *JsonApi) countPanic(msgtype string) {
+	api.metricsLock.Lock()
+	defer api.metricsLock.Unlock()
+	api.metrics.Panics[msgtype]++
+}
+
+func (api *JsonApi) countTimeout(msgtype string) {
+	api.metricsLock.Lock()
+	defer api.metricsLock.Unlock()
+	api.metrics.Timeouts[msgtype]++
+}
+
+type GetApiMetricsRequest struct{}
+
+func (api *JsonApi) handleGetApiMetricsRequest(req *GetApiMetricsRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+	responseCh <- api.Metrics()
+}
@@ -0,0 +1,139 @@
+package jsonapi
+
+import (
+	"reflect"
+	"strings"
+)
+
+// ApiVersion is increased whenever an API call or message type is changed in
+// a way that is not backwards compatible. Clients can compare it to the
+// version they were written for.
+const ApiVersion = 1
+
+// JsonSchema is a JSON Schema (draft-07) document or subschema.
+type JsonSchema map[string]interface{}
+
+type DescribeApiRequest struct{}
+
+// ApiDescription lists every API call and the JSON Schema of every
+// registered message type. It is returned by the describe_api call
+// and served as /api/schema.json.
+type ApiDescription struct {
+	Schema      string                `json:"$schema"`
+	Version     int                   `json:"version"`
+	Calls       []ApiCallDescription  `json:"calls"`
+	Definitions map[string]JsonSchema `json:"definitions"`
+}
+
+// ApiCallDescription describes a single API call. Request is a JSON pointer
+// to the schema of the initial message in ApiDescription.Definitions.
+type ApiCallDescription struct {
+	Msgtype   string `json:"msgtype"`
+	Streaming bool   `json:"streaming"`
+	Request   string `json:"request"`
+}
+
+// Describe returns a description of all registered API calls and message types.
+func (api *JsonApi) Describe() ApiDescription {
+	desc := ApiDescription{
+		Schema:      "http://json-schema.org/draft-07/schema#",
+		Version:     ApiVersion,
+		Calls:       make([]ApiCallDescription, 0),
+		Definitions: make(map[string]JsonSchema),
+	}
+
+	for _, msgtype := range api.ApiCallNames() {
+		desc.Calls = append(desc.Calls, ApiCallDescription{
+			Msgtype:   msgtype,
+			Streaming: api.IsStreamingApiCall(msgtype),
+			Request:   "#/definitions/" + msgtype,
+		})
+	}
+
+	api.lock.RLock()
+	defer api.lock.RUnlock()
+	for msgtype, typ := range api.msgtypeToGoType {
+		schema := schemaForType(typ, make(map[reflect.Type]bool))
+		schema["title"] = typ.Name()
+		desc.Definitions[msgtype] = schema
+	}
+	return desc
+}
+
+func (api *JsonApi) handleDescribeApiRequest(req *DescribeApiRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+	responseCh <- api.Describe()
+}
+
+// schemaForType builds a JSON Schema for a Go type following the rules
+// of the encoding/json package. Types that are currently being visited
+// (recursive types) are described by the empty schema.
+func schemaForType(t reflect.Type, visiting map[reflect.Type]bool) JsonSchema {
+	if t == reflect.TypeOf(BinaryData(nil)) {
+		return JsonSchema{"type": "string", "contentEncoding": "base64"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaForType(t.Elem(), visiting)
+	case reflect.Bool:
+		return JsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return JsonSchema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return JsonSchema{"type": "number"}
+	case reflect.String:
+		return JsonSchema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return JsonSchema{"type": "string", "contentEncoding": "base64"}
+		}
+		return JsonSchema{"type": []string{"array", "null"}, "items": schemaForType(t.Elem(), visiting)}
+	case reflect.Map:
+		return JsonSchema{"type": []string{"object", "null"}, "additionalProperties": schemaForType(t.Elem(), visiting)}
+	case reflect.Struct:
+		if visiting[t] {
+			return JsonSchema{}
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+
+		properties := make(map[string]JsonSchema)
+		addStructFields(t, properties, visiting)
+		return JsonSchema{"type": "object", "properties": properties}
+	}
+	// interface{} and everything else can hold any value
+	return JsonSchema{}
+}
+
+// addStructFields adds the schemas of all fields that encoding/json
+// would serialize to properties. Embedded structs are flattened.
+func addStructFields(t reflect.Type, properties map[string]JsonSchema, visiting map[reflect.Type]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		if field.Anonymous && name == "" {
+			ft := field.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				addStructFields(ft, properties, visiting)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemaForType(field.Type, visiting)
+	}
+}
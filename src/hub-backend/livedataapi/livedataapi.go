@@ -1,6 +1,7 @@
 package livedataapi
 
 import (
+	"context"
 	"sync"
 
 	"dcs-bios.a10c.de/dcs-bios-hub/jsonapi"
@@ -20,7 +21,7 @@ func NewLiveDataApi(jsonAPI *jsonapi.JsonApi) *LiveDataApi {
 		exportDataListeners: make(map[chan []byte]struct{}),
 	}
 	jsonAPI.RegisterType("live_data", LiveDataRequest{})
-	jsonAPI.RegisterApiCall("live_data", lda.HandleLiveDataRequest)
+	jsonAPI.RegisterStreamingApiCall("live_data", lda.HandleLiveDataRequest)
 	jsonAPI.RegisterType("input_command", InputCommandMessage(""))
 	return lda
 }
@@ -36,19 +37,20 @@ func (lda *LiveDataApi) WriteExportData(data []byte) {
 type LiveDataRequest struct{}
 type InputCommandMessage string
 
-func (lda *LiveDataApi) HandleLiveDataRequest(req *LiveDataRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+func (lda *LiveDataApi) HandleLiveDataRequest(ctx context.Context, req *LiveDataRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
 	// accept input commands from the web socket connection for as long as it is alive
-	onClose := make(chan struct{}) // this will be closed by the command listener goroutine once the followupChannel is closed
 	go func() {
 		for msg := range followupCh {
 
 			if msgStr, ok := msg.(*InputCommandMessage); ok {
 
 				msgBytes := []byte(*msgStr)
-				lda.InputCommands <- msgBytes
+				select {
+				case lda.InputCommands <- msgBytes:
+				case <-ctx.Done():
+				}
 			}
 		}
-		close(onClose)
 	}()
 
 	exportDataChannel := make(chan []byte)
@@ -57,15 +59,26 @@ func (lda *LiveDataApi) HandleLiveDataRequest(req *LiveDataRequest, responseCh c
 	lda.exportDataListeners[exportDataChannel] = struct{}{}
 	lda.listenerLock.Unlock()
 
-	// copy export data to the response channel until the followup channel is closed
+	// copy export data to the response channel until the connection is closed
 	for {
 		select {
 		case data := <-exportDataChannel:
-			responseCh <- jsonapi.BinaryData(data)
-		case <-onClose:
+			select {
+			case responseCh <- jsonapi.BinaryData(data):
+			case <-ctx.Done():
+			}
+		case <-ctx.Done():
+			// WriteExportData() may be blocked sending to exportDataChannel
+			// while holding the listenerLock, so keep draining it until
+			// we have unsubscribed.
+			go func() {
+				for range exportDataChannel {
+				}
+			}()
 			lda.listenerLock.Lock()
 			delete(lda.exportDataListeners, exportDataChannel)
 			lda.listenerLock.Unlock()
+			close(exportDataChannel)
 			close(responseCh)
 			return
 		}
@@ -0,0 +1,80 @@
+package livedataapi
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"dcs-bios.a10c.de/dcs-bios-hub/internal/testutil"
+	"dcs-bios.a10c.de/dcs-bios-hub/jsonapi"
+)
+
+func TestCancelledLiveDataRequestUnsubscribes(t *testing.T) {
+	base := runtime.NumGoroutine()
+	lda := NewLiveDataApi(jsonapi.NewJsonApi(context.Background()))
+
+	followup := make(chan []byte)
+	responses, err := lda.jsonAPI.HandleApiCall([]byte(`{"datatype": "live_data", "data": {}}`), followup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// keep writing export data while the request is cancelled, so that
+	// WriteExportData is blocked on the listener when it unsubscribes
+	writerDone := make(chan struct{})
+	stopWriter := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for {
+			select {
+			case <-stopWriter:
+				return
+			default:
+				lda.WriteExportData([]byte{0x55, 0x55, 0x55, 0x55})
+			}
+		}
+	}()
+
+	<-responses
+	close(followup)
+	for range responses {
+	}
+	close(stopWriter)
+	<-writerDone
+	testutil.WaitForGoroutines(t, base)
+
+	lda.listenerLock.Lock()
+	listeners := len(lda.exportDataListeners)
+	lda.listenerLock.Unlock()
+	if listeners != 0 {
+		t.Errorf("%d export data listeners are still registered", listeners)
+	}
+}
+
+func TestCancellingApiContextStopsLiveDataRequest(t *testing.T) {
+	base := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	lda := NewLiveDataApi(jsonapi.NewJsonApi(ctx))
+
+	followup := make(chan []byte)
+	responses, err := lda.jsonAPI.HandleApiCall([]byte(`{"datatype": "live_data", "data": {}}`), followup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the request may not have subscribed to the export data yet
+	for subscribed := false; !subscribed; {
+		lda.WriteExportData([]byte{0x55, 0x55, 0x55, 0x55})
+		select {
+		case <-responses:
+			subscribed = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	cancel()
+	for range responses {
+	}
+	close(followup)
+	testutil.WaitForGoroutines(t, base)
+}
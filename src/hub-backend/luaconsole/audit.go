@@ -0,0 +1,268 @@
+package luaconsole
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"dcs-bios.a10c.de/dcs-bios-hub/configstore"
+	"dcs-bios.a10c.de/dcs-bios-hub/gui"
+	"dcs-bios.a10c.de/dcs-bios-hub/jsonapi"
+)
+
+// auditLogFile is the configstore file that every execute_lua_snippet call
+// is recorded in, one JSON object per line. Entries are only ever appended.
+const auditLogFile = "luaconsoleaudit.log"
+
+// defaultAuditLogLimit is the number of entries returned by
+// get_lua_audit_log if the request does not specify a limit.
+const defaultAuditLogLimit = 100
+
+// confirmationTimeout is the time the user has to confirm a snippet
+// that was sent from another computer. Together with the time DCS may take
+// to execute the snippet (responseTimeout), it must stay well below the
+// response timeout of the API, so the client gets the actual result.
+const confirmationTimeout = 30 * time.Second
+
+// confirmationPending is set while a confirmation dialog is open.
+// Only one dialog is shown at a time; snippets from other computers
+// are rejected until it has been closed. It is protected by confirmationLock.
+var confirmationPending bool
+var confirmationLock sync.Mutex
+
+var (
+	errConfirmationPending = errors.New("Another snippet is waiting for confirmation on the DCS-BIOS Hub computer.")
+	errNotConfirmed        = errors.New("The snippet was not confirmed on the DCS-BIOS Hub computer.")
+)
+
+// Status values of audit log entries. Snippets executed in DCS are
+// completed with the status reported by the Lua Console hook instead
+// ("success", "syntax_error", "runtime_error", ...).
+const (
+	auditStatusStarted  = "started"  // the snippet is being executed
+	auditStatusSuccess  = "success"  // the snippet was executed in the hub
+	auditStatusError    = "error"    // the snippet could not be executed
+	auditStatusDisabled = "disabled" // the Lua Console is disabled
+	auditStatusRejected = "rejected" // the user did not confirm the snippet
+)
+
+// AuditLogEntry records a single execute_lua_snippet call.
+// RemoteAddr is empty for calls that did not come from the network.
+//
+// An entry with the status "started" is written before a snippet is executed.
+// When it has finished, another line with the same ID and only the final
+// status is appended; readAuditLog combines both lines into one entry.
+type AuditLogEntry struct {
+	ID             int64     `json:"id,omitempty"`
+	Time           time.Time `json:"time"`
+	RemoteAddr     string    `json:"remoteAddr,omitempty"`
+	LuaEnvironment string    `json:"luaEnvironment,omitempty"`
+	CodeSHA256     string    `json:"codeSHA256,omitempty"`
+	LuaCode        string    `json:"luaCode,omitempty"`
+	Status         string    `json:"status"`
+}
+
+var auditLogLock sync.Mutex // protects the audit log file and lastAuditID
+var lastAuditID int64
+
+func newAuditLogEntry(remoteAddr string, luaEnvironment string, code string, status string) AuditLogEntry {
+	hash := sha256.Sum256([]byte(code))
+	return AuditLogEntry{
+		Time:           time.Now(),
+		RemoteAddr:     remoteAddr,
+		LuaEnvironment: luaEnvironment,
+		CodeSHA256:     hex.EncodeToString(hash[:]),
+		LuaCode:        code,
+		Status:         status,
+	}
+}
+
+// writeAuditLog appends an entry for a snippet that was not executed to the audit log.
+func writeAuditLog(remoteAddr string, luaEnvironment string, code string, status string) {
+	auditLogLock.Lock()
+	defer auditLogLock.Unlock()
+	appendAuditLogEntry(newAuditLogEntry(remoteAddr, luaEnvironment, code, status))
+}
+
+// startAuditLogEntry appends an entry for a snippet that is about to be
+// executed to the audit log. It returns the ID to pass to finishAuditLogEntry.
+func startAuditLogEntry(remoteAddr string, luaEnvironment string, code string) int64 {
+	auditLogLock.Lock()
+	defer auditLogLock.Unlock()
+	entry := newAuditLogEntry(remoteAddr, luaEnvironment, code, auditStatusStarted)
+	entry.ID = entry.Time.UnixNano()
+	if entry.ID <= lastAuditID {
+		entry.ID = lastAuditID + 1
+	}
+	lastAuditID = entry.ID
+	appendAuditLogEntry(entry)
+	return entry.ID
+}
+
+// finishAuditLogEntry records the final status of the snippet
+// that was started with the given ID.
+func finishAuditLogEntry(id int64, status string) {
+	auditLogLock.Lock()
+	defer auditLogLock.Unlock()
+	appendAuditLogEntry(AuditLogEntry{ID: id, Time: time.Now(), Status: status})
+}
+
+// appendAuditLogEntry writes an entry to the audit log. The caller must hold auditLogLock.
+func appendAuditLogEntry(entry AuditLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Printf("luaconsole: could not encode audit log entry: %v\n", err)
+		return
+	}
+
+	file, err := os.OpenFile(configstore.GetFilePath(auditLogFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		fmt.Printf("luaconsole: could not open audit log: %v\n", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		fmt.Printf("luaconsole: could not write audit log: %v\n", err)
+	}
+}
+
+// readAuditLog returns the last limit entries of the audit log.
+// The final status of a snippet is merged into the entry that started it.
+func readAuditLog(limit int) ([]AuditLogEntry, error) {
+	auditLogLock.Lock()
+	defer auditLogLock.Unlock()
+
+	file, err := configstore.OpenFile(auditLogFile)
+	if os.IsNotExist(err) {
+		return make([]AuditLogEntry, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]*AuditLogEntry, 0)
+	started := make(map[int64]*AuditLogEntry)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry AuditLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // skip a line that was only partially written
+		}
+		if entry.ID != 0 && entry.Status != auditStatusStarted {
+			// the start of an older snippet may already have been discarded
+			if startEntry, ok := started[entry.ID]; ok {
+				startEntry.Status = entry.Status
+			}
+			continue
+		}
+		entries = append(entries, &entry)
+		if entry.ID != 0 {
+			started[entry.ID] = &entry
+		}
+		if len(entries) > limit {
+			delete(started, entries[0].ID)
+			entries = entries[1:]
+		}
+	}
+
+	result := make([]AuditLogEntry, len(entries))
+	for i, entry := range entries {
+		result[i] = *entry
+	}
+	return result, scanner.Err()
+}
+
+// isRemoteAddr returns true if remoteAddr is the address of another computer.
+// Calls that did not come from the network have an empty remoteAddr.
+func isRemoteAddr(remoteAddr string) bool {
+	if remoteAddr == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return true // err on the side of caution
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || !ip.IsLoopback()
+}
+
+// confirmRemoteSnippet asks the user whether a snippet that was sent from
+// another computer may be executed and returns nil if it may. If the user
+// does not answer before ctx is done or the confirmation times out, the
+// snippet is rejected. The dialog closes itself after confirmationTimeout,
+// so it cannot be answered after the snippet has been rejected.
+func confirmRemoteSnippet(ctx context.Context, remoteAddr string, luaEnvironment string, code string) error {
+	confirmationLock.Lock()
+	if confirmationPending {
+		confirmationLock.Unlock()
+		return errConfirmationPending
+	}
+	confirmationPending = true
+	confirmationLock.Unlock()
+
+	const maxDisplayedCode = 1000
+	displayedCode := code
+	if len(displayedCode) > maxDisplayedCode {
+		displayedCode = displayedCode[:maxDisplayedCode] + "\n[...]"
+	}
+	msg := fmt.Sprintf("%s wants to execute the following Lua code in the %q environment:\n\n%s\n\nDo you want to allow this?", remoteAddr, luaEnvironment, displayedCode)
+
+	answer := make(chan bool, 1)
+	go func() {
+		confirmed := gui.ConfirmMsgBox(msg, "DCS-BIOS Lua Console", confirmationTimeout)
+		confirmationLock.Lock()
+		confirmationPending = false
+		confirmationLock.Unlock()
+		answer <- confirmed
+	}()
+	select {
+	case confirmed := <-answer:
+		if !confirmed {
+			return errNotConfirmed
+		}
+		return nil
+	case <-ctx.Done():
+		// the dialog stays open until it times out, so
+		// no other dialog can be opened in the meantime
+		return errNotConfirmed
+	}
+}
+
+type GetLuaAuditLogRequest struct {
+	// the number of entries to return, starting with the most recent one
+	Limit int `json:"limit,omitempty"`
+}
+
+type LuaAuditLog []AuditLogEntry
+
+// HandleGetLuaAuditLogRequest returns the most recent entries of the audit log.
+// It is only available to clients on the same computer.
+func (lcs *LuaConsoleServer) HandleGetLuaAuditLogRequest(ctx context.Context, req *GetLuaAuditLogRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+	if isRemoteAddr(jsonapi.RemoteAddr(ctx)) {
+		responseCh <- jsonapi.ErrorResult{Message: "The Lua audit log can only be read on the DCS-BIOS Hub computer.", Code: http.StatusForbidden}
+		return
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultAuditLogLimit
+	}
+	entries, err := readAuditLog(limit)
+	if err != nil {
+		responseCh <- jsonapi.ErrorResult{Message: "could not read the audit log: " + err.Error()}
+		return
+	}
+	responseCh <- LuaAuditLog(entries)
+}
@@ -0,0 +1,93 @@
+package luaconsole
+
+import (
+	"dcs-bios.a10c.de/dcs-bios-hub/luastate"
+	"dcs-bios.a10c.de/dcs-bios-hub/statusapi"
+)
+
+// dcsEnvironments are the Lua environments in DCS that the Lua Console hook
+// can execute snippets in, if they exist at the moment.
+var dcsEnvironments = []LuaEnvironment{
+	{Name: "gui", Description: "the environment of the Lua Console hook (GameGUI)"},
+	{Name: "export", Description: "the Export.lua environment"},
+	{Name: "mission", Description: "the mission scripting environment of triggers"},
+	{Name: "server", Description: "the server environment of a multiplayer session"},
+	{Name: "config", Description: "the configuration environment"},
+}
+
+type GetLuaEnvironmentsRequest struct{}
+
+// LuaEnvironment is a value for ExecuteSnippetRequest.LuaEnvironment.
+// Available is false for environments in DCS that do not exist at the moment,
+// e.g. "mission" when no mission is running or any of them if DCS is not connected.
+type LuaEnvironment struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Available   bool   `json:"available"`
+}
+
+type LuaEnvironments struct {
+	Environments          []LuaEnvironment `json:"environments"`
+	IsLuaConsoleConnected bool             `json:"isLuaConsoleConnected"`
+	DcsVersion            string           `json:"dcsVersion"`
+	Mission               string           `json:"mission"`
+}
+
+// updateDcsInfo stores an "info" message from DCS and publishes it
+// through the status API.
+func (lcs *LuaConsoleServer) updateDcsInfo(msg dcsMessage) {
+	lcs.connLock.Lock()
+	lcs.dcsInfo = msg
+	lcs.connLock.Unlock()
+
+	statusapi.WithStatusInfoDo(func(si *statusapi.StatusInfo) {
+		si.DcsVersion = msg.DcsVersion
+		si.Mission = msg.Mission
+		si.LuaEnvironments = msg.Environments
+	})
+}
+
+func (lcs *LuaConsoleServer) HandleGetLuaEnvironmentsRequest(req *GetLuaEnvironmentsRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+
+	lcs.connLock.Lock()
+	info := lcs.dcsInfo
+	connected := lcs.conn != nil
+	lcs.connLock.Unlock()
+
+	result := LuaEnvironments{
+		Environments:          make([]LuaEnvironment, 0),
+		IsLuaConsoleConnected: connected,
+		DcsVersion:            info.DcsVersion,
+		Mission:               info.Mission,
+	}
+	for _, name := range luastate.ConsoleEnvironments() {
+		description := "the Lua console of the DCS-BIOS Hub"
+		if name != "hub" {
+			description = "the hub script " + name[len("hub:"):]
+		}
+		result.Environments = append(result.Environments, LuaEnvironment{
+			Name:        name,
+			Description: description,
+			Available:   true,
+		})
+	}
+
+	reported := make(map[string]bool)
+	for _, name := range info.Environments {
+		reported[name] = true
+	}
+	for _, env := range dcsEnvironments {
+		env.Available = reported[env.Name]
+		delete(reported, env.Name)
+		result.Environments = append(result.Environments, env)
+	}
+	// environments reported by future versions of the hook
+	for _, name := range info.Environments {
+		if reported[name] {
+			result.Environments = append(result.Environments, LuaEnvironment{Name: name, Available: true})
+		}
+	}
+
+	responseCh <- result
+}
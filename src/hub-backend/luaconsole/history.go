@@ -0,0 +1,120 @@
+package luaconsole
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"dcs-bios.a10c.de/dcs-bios-hub/configstore"
+	"dcs-bios.a10c.de/dcs-bios-hub/gui"
+	"dcs-bios.a10c.de/dcs-bios-hub/jsonapi"
+)
+
+// historyFile is the configstore file that holds the Lua console history.
+const historyFile = "luaconsolehistory.json"
+
+// maxHistoryEntries is the number of snippets that are kept in the history.
+const maxHistoryEntries = 1000
+
+// HistoryEntry is a snippet that was executed in the Lua console.
+type HistoryEntry struct {
+	Time           time.Time `json:"time"`
+	LuaEnvironment string    `json:"luaEnvironment"`
+	LuaCode        string    `json:"luaCode"`
+}
+
+var history []HistoryEntry
+var historyLoaded bool
+var historyLock sync.Mutex
+
+// loadHistory reads the history from the configstore the first time it is needed.
+// The caller must hold historyLock.
+func loadHistory() {
+	if historyLoaded {
+		return
+	}
+	historyLoaded = true
+	configstore.Load(historyFile, &history)
+}
+
+// addToHistory appends a snippet to the history unless it is the same as the
+// previous entry, and writes the history to the configstore.
+func addToHistory(luaEnvironment string, code string) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	loadHistory()
+
+	if n := len(history); n > 0 && history[n-1].LuaEnvironment == luaEnvironment && history[n-1].LuaCode == code {
+		history[n-1].Time = time.Now()
+	} else {
+		history = append(history, HistoryEntry{
+			Time:           time.Now(),
+			LuaEnvironment: luaEnvironment,
+			LuaCode:        code,
+		})
+	}
+	if len(history) > maxHistoryEntries {
+		history = append([]HistoryEntry(nil), history[len(history)-maxHistoryEntries:]...)
+	}
+	configstore.Store(historyFile, history)
+}
+
+type GetLuaConsoleHistoryRequest struct {
+	// only return snippets for this environment if not empty
+	LuaEnvironment string `json:"luaEnvironment,omitempty"`
+}
+
+type LuaConsoleHistory []HistoryEntry
+
+// checkHistoryAccess sends an error and returns false if the history may
+// not be accessed. Like the audit log, the history contains the code that
+// was sent by every client, so it is only available on the same computer.
+func checkHistoryAccess(ctx context.Context, responseCh chan<- interface{}) bool {
+	if !gui.IsLuaConsoleEnabled() {
+		responseCh <- jsonapi.ErrorResult{Message: "The Lua Console is disabled.", Code: http.StatusForbidden}
+		return false
+	}
+	if isRemoteAddr(jsonapi.RemoteAddr(ctx)) {
+		responseCh <- jsonapi.ErrorResult{Message: "The Lua Console history can only be accessed on the DCS-BIOS Hub computer.", Code: http.StatusForbidden}
+		return false
+	}
+	return true
+}
+
+func (lcs *LuaConsoleServer) HandleGetLuaConsoleHistoryRequest(ctx context.Context, req *GetLuaConsoleHistoryRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+	if !checkHistoryAccess(ctx, responseCh) {
+		return
+	}
+
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	loadHistory()
+	entries := make(LuaConsoleHistory, 0, len(history))
+	for _, entry := range history {
+		if req.LuaEnvironment == "" || entry.LuaEnvironment == req.LuaEnvironment {
+			entries = append(entries, entry)
+		}
+	}
+	responseCh <- entries
+}
+
+type ClearLuaConsoleHistoryRequest struct{}
+
+func (lcs *LuaConsoleServer) HandleClearLuaConsoleHistoryRequest(ctx context.Context, req *ClearLuaConsoleHistoryRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+	if !checkHistoryAccess(ctx, responseCh) {
+		return
+	}
+
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	historyLoaded = true
+	history = nil
+	if err := configstore.Store(historyFile, make([]HistoryEntry, 0)); err != nil {
+		responseCh <- jsonapi.ErrorResult{Message: "could not clear the history: " + err.Error()}
+		return
+	}
+	responseCh <- jsonapi.SuccessResult{Message: "history cleared"}
+}
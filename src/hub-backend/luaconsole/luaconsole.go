@@ -1,9 +1,13 @@
 package luaconsole
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,25 +21,68 @@ type LuaResult struct {
 	Type   string `json:"type"`
 	Result string `json:"result"`
 	Status string `json:"status"`
+	// every return value of a snippet executed in a "hub" environment,
+	// Result contains them separated by commas
+	Results []string `json:"results,omitempty"`
 }
 
+// dcsMessage is a message sent by the Lua Console hook in DCS.
+// ID is the id of the request a "luaresult" message answers. Hooks that were
+// installed by older versions of DCS-BIOS do not send it.
+// "info" messages report the environments that snippets can be executed in,
+// the DCS version and the name of the current mission.
+type dcsMessage struct {
+	Type         string   `json:"type"`
+	ID           int      `json:"id"`
+	Result       string   `json:"result"`
+	Status       string   `json:"status"`
+	Environments []string `json:"environments"`
+	DcsVersion   string   `json:"dcsVersion"`
+	Mission      string   `json:"mission"`
+}
+
+// sendTimeout is the time to wait for the connection to DCS to accept a request.
+const sendTimeout = 1 * time.Second
+
+// responseTimeout is the time to wait for DCS to answer a request.
+// DCS executes snippets in its simulation loop, so this includes the time
+// spent waiting for the snippets that were sent before.
+const responseTimeout = 10 * time.Second
+
+// dcsReply is the answer to a request that has been sent to DCS.
+type dcsReply struct {
+	result LuaResult
+	err    error
+}
+
+var (
+	errConnectionClosed = errors.New("the connection to DCS was closed before the snippet returned.")
+	errResultWithoutID  = errors.New("DCS returned a result without a request id while several snippets were waiting, so it could not be matched to a snippet. Reinstall the Lua Console hook on the DCS Connection page.")
+)
+
 type LuaConsoleServer struct {
-	jsonAPI         *jsonapi.JsonApi
-	requestToDcs    chan interface{}
-	responseFromDcs chan LuaResult
-	conn            net.Conn
-	connLock        sync.Mutex
+	jsonAPI      *jsonapi.JsonApi
+	requestToDcs chan interface{}
+	conn         net.Conn
+	dcsInfo      dcsMessage // the last "info" message from DCS
+	connLock     sync.Mutex // protects conn and dcsInfo
+	// requests that have been sent to DCS and not been answered yet, by id
+	pending       map[int]chan dcsReply
+	nextRequestID int
+	pendingLock   sync.Mutex
 }
 
 func NewServer(jsonAPI *jsonapi.JsonApi) *LuaConsoleServer {
 	return &LuaConsoleServer{
-		jsonAPI:         jsonAPI,
-		requestToDcs:    make(chan interface{}),
-		responseFromDcs: make(chan LuaResult),
+		jsonAPI:      jsonAPI,
+		requestToDcs: make(chan interface{}),
+		pending:      make(map[int]chan dcsReply),
 	}
 }
 
-func (lcs *LuaConsoleServer) Run() {
+// Run accepts connections from the Lua Console hook in DCS
+// until ctx is cancelled.
+func (lcs *LuaConsoleServer) Run(ctx context.Context) {
 	listener, err := net.Listen("tcp", "localhost:3001")
 	if err != nil {
 		fmt.Println("luaconsole: could not listen on port 3001")
@@ -46,20 +93,56 @@ func (lcs *LuaConsoleServer) Run() {
 	lcs.jsonAPI.RegisterType("lua_result", LuaResult{})
 	lcs.jsonAPI.RegisterApiCall("execute_lua_snippet", lcs.HandleExecuteSnippetRequest)
 
-	defer listener.Close()
+	lcs.jsonAPI.RegisterType("complete_lua_snippet", CompleteSnippetRequest{})
+	lcs.jsonAPI.RegisterType("lua_completions", LuaCompletions{})
+	lcs.jsonAPI.RegisterApiCall("complete_lua_snippet", lcs.HandleCompleteSnippetRequest)
+
+	lcs.jsonAPI.RegisterType("end_lua_console_session", EndSessionRequest{})
+	lcs.jsonAPI.RegisterApiCall("end_lua_console_session", lcs.HandleEndSessionRequest)
+
+	lcs.jsonAPI.RegisterType("get_lua_environments", GetLuaEnvironmentsRequest{})
+	lcs.jsonAPI.RegisterType("lua_environments", LuaEnvironments{})
+	lcs.jsonAPI.RegisterApiCall("get_lua_environments", lcs.HandleGetLuaEnvironmentsRequest)
+
+	lcs.jsonAPI.RegisterType("get_lua_audit_log", GetLuaAuditLogRequest{})
+	lcs.jsonAPI.RegisterType("lua_audit_log", LuaAuditLog(nil))
+	lcs.jsonAPI.RegisterApiCall("get_lua_audit_log", lcs.HandleGetLuaAuditLogRequest)
+
+	lcs.jsonAPI.RegisterType("get_lua_console_history", GetLuaConsoleHistoryRequest{})
+	lcs.jsonAPI.RegisterType("lua_console_history", LuaConsoleHistory(nil))
+	lcs.jsonAPI.RegisterApiCall("get_lua_console_history", lcs.HandleGetLuaConsoleHistoryRequest)
+
+	lcs.jsonAPI.RegisterType("clear_lua_console_history", ClearLuaConsoleHistoryRequest{})
+	lcs.jsonAPI.RegisterApiCall("clear_lua_console_history", lcs.HandleClearLuaConsoleHistoryRequest)
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
 			fmt.Println("luaconsole: error accepting connection: " + err.Error())
 			continue
 		}
+		lcs.connLock.Lock()
 		if lcs.conn != nil {
 			lcs.conn.Close()
 		}
 		lcs.conn = conn
+		lcs.connLock.Unlock()
 		go lcs.handleConnection(conn)
 	}
+
+	lcs.connLock.Lock()
+	if lcs.conn != nil {
+		lcs.conn.Close()
+	}
+	lcs.connLock.Unlock()
 }
 
 func (lcs *LuaConsoleServer) handleConnection(conn net.Conn) {
@@ -67,11 +150,17 @@ func (lcs *LuaConsoleServer) handleConnection(conn net.Conn) {
 	statusapi.WithStatusInfoDo(func(si *statusapi.StatusInfo) {
 		si.IsLuaConsoleConnected = true
 	})
+	connClosed := make(chan struct{})
 	go func() {
 		enc := json.NewEncoder(conn)
 		enc.SetEscapeHTML(false)
 		for {
-			req := <-lcs.requestToDcs
+			var req interface{}
+			select {
+			case req = <-lcs.requestToDcs:
+			case <-connClosed:
+				return
+			}
 			fmt.Println("sending", req)
 			if err := enc.Encode(req); err != nil {
 				conn.Close()
@@ -82,17 +171,33 @@ func (lcs *LuaConsoleServer) handleConnection(conn net.Conn) {
 
 	go func() {
 		dec := json.NewDecoder(conn)
-		var dcsResponse LuaResult
 		for {
-			if err := dec.Decode(&dcsResponse); err != nil {
+			var msg dcsMessage
+			if err := dec.Decode(&msg); err != nil {
 				conn.Close()
+				close(connClosed)
+				lcs.connLock.Lock()
+				if lcs.conn == conn {
+					// requests sent after DCS reconnected are answered by the new connection
+					lcs.failPendingRequests(errConnectionClosed)
+					lcs.conn = nil
+					lcs.dcsInfo = dcsMessage{}
+				}
+				lcs.connLock.Unlock()
 				statusapi.WithStatusInfoDo(func(si *statusapi.StatusInfo) {
 					si.IsLuaConsoleConnected = false
+					si.DcsVersion = ""
+					si.Mission = ""
+					si.LuaEnvironments = nil
 				})
 				return
 			}
-			if dcsResponse.Type != "ping" {
-				lcs.responseFromDcs <- dcsResponse
+			switch msg.Type {
+			case "ping":
+			case "info":
+				lcs.updateDcsInfo(msg)
+			default:
+				lcs.deliverResponse(msg)
 			}
 		}
 	}()
@@ -101,47 +206,215 @@ func (lcs *LuaConsoleServer) handleConnection(conn net.Conn) {
 type ExecuteSnippetRequest struct {
 	LuaEnvironment string `json:"luaEnvironment"`
 	LuaCode        string `json:"luaCode"`
+	// In the "hub" environments, top-level local variables are kept
+	// between snippets with the same session id.
+	SessionID string `json:"sessionId,omitempty"`
+}
+
+// hubScriptName returns whether luaEnv is the Lua console of the
+// DCS-BIOS Hub ("hub") or a running hub script ("hub:<script>").
+// For the Lua console, the returned script name is empty.
+func hubScriptName(luaEnv string) (scriptName string, isHub bool) {
+	if luaEnv == "hub" {
+		return "", true
+	}
+	if strings.HasPrefix(luaEnv, "hub:") {
+		return strings.TrimPrefix(luaEnv, "hub:"), true
+	}
+	return "", false
 }
 
-func (lcs *LuaConsoleServer) HandleExecuteSnippetRequest(req *ExecuteSnippetRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+// HandleExecuteSnippetRequest executes a snippet in a Lua environment.
+// Every call is recorded in the audit log. If the call comes from another
+// computer and confirmation is enabled in the system tray menu, the user
+// has to allow the snippet first.
+func (lcs *LuaConsoleServer) HandleExecuteSnippetRequest(ctx context.Context, req *ExecuteSnippetRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
 	defer close(responseCh)
+	remoteAddr := jsonapi.RemoteAddr(ctx)
 	if !gui.IsLuaConsoleEnabled() {
-		responseCh <- jsonapi.ErrorResult{Message: "The Lua Console is disabled."}
+		writeAuditLog(remoteAddr, req.LuaEnvironment, req.LuaCode, auditStatusDisabled)
+		responseCh <- jsonapi.ErrorResult{Message: "The Lua Console is disabled.", Code: http.StatusForbidden}
 		return
 	}
+	if isRemoteAddr(remoteAddr) && gui.IsRemoteLuaConfirmationEnabled() {
+		if err := confirmRemoteSnippet(ctx, remoteAddr, req.LuaEnvironment, req.LuaCode); err != nil {
+			writeAuditLog(remoteAddr, req.LuaEnvironment, req.LuaCode, auditStatusRejected)
+			code := http.StatusForbidden
+			if err == errConfirmationPending {
+				code = http.StatusConflict
+			}
+			responseCh <- jsonapi.ErrorResult{Message: err.Error(), Code: code}
+			return
+		}
+	}
+
+	addToHistory(req.LuaEnvironment, req.LuaCode)
+	auditID := startAuditLogEntry(remoteAddr, req.LuaEnvironment, req.LuaCode)
 
-	if req.LuaEnvironment == "hub" {
-		resultStr, err := luastate.DoStringAndSerializeResult(req.LuaCode)
+	if scriptName, isHub := hubScriptName(req.LuaEnvironment); isHub {
+		results, err := luastate.ExecuteConsoleSnippet(scriptName, req.SessionID, req.LuaCode)
 		if err != nil {
+			finishAuditLogEntry(auditID, auditStatusError)
 			responseCh <- jsonapi.ErrorResult{
 				Message: err.Error(),
 			}
 			return
 		}
+		finishAuditLogEntry(auditID, auditStatusSuccess)
 		responseCh <- LuaResult{
-			Type:   "string",
-			Status: "success",
-			Result: resultStr,
+			Type:    "string",
+			Status:  "success",
+			Result:  strings.Join(results, ", "),
+			Results: results,
 		}
 		return
 	}
 
-	request := map[string]string{
+	result, err := lcs.executeInDcs(req.LuaEnvironment, req.LuaCode)
+	if err != nil {
+		finishAuditLogEntry(auditID, auditStatusError)
+		responseCh <- jsonapi.ErrorResult{
+			Message: err.Error(),
+			Code:    http.StatusGatewayTimeout,
+		}
+		return
+	}
+	finishAuditLogEntry(auditID, result.Status)
+	responseCh <- result
+}
+
+// executeInDcs sends a snippet to the Lua Console hook in DCS and waits
+// for the result. Several snippets can be in flight at the same time;
+// responses are matched to their request by the request id.
+func (lcs *LuaConsoleServer) executeInDcs(luaEnv string, code string) (LuaResult, error) {
+	resultCh := make(chan dcsReply, 1)
+	lcs.pendingLock.Lock()
+	lcs.nextRequestID++
+	id := lcs.nextRequestID
+	lcs.pending[id] = resultCh
+	lcs.pendingLock.Unlock()
+	defer lcs.removePendingRequest(id)
+
+	request := map[string]interface{}{
 		"type":   "lua",
+		"id":     id,
 		"name":   "irrelevant",
-		"luaenv": req.LuaEnvironment,
-		"code":   req.LuaCode,
+		"luaenv": luaEnv,
+		"code":   code,
 	}
 
-	lcs.connLock.Lock()
-	defer lcs.connLock.Unlock()
 	select {
 	case lcs.requestToDcs <- request:
-		var result LuaResult = <-lcs.responseFromDcs
-		responseCh <- result
-	case <-time.After(1 * time.Second):
-		responseCh <- jsonapi.ErrorResult{
-			Message: "could not send snippet to DCS within 1 second.",
+	case <-time.After(sendTimeout):
+		return LuaResult{}, errors.New("could not send snippet to DCS within 1 second.")
+	}
+
+	select {
+	case reply := <-resultCh:
+		return reply.result, reply.err
+	case <-time.After(responseTimeout):
+		return LuaResult{}, fmt.Errorf("DCS did not return a result within %v.", responseTimeout)
+	}
+}
+
+func (lcs *LuaConsoleServer) removePendingRequest(id int) {
+	lcs.pendingLock.Lock()
+	defer lcs.pendingLock.Unlock()
+	delete(lcs.pending, id)
+}
+
+// deliverResponse passes a result from DCS on to the request it answers.
+// Results for requests that have already timed out are dropped.
+func (lcs *LuaConsoleServer) deliverResponse(msg dcsMessage) {
+	lcs.pendingLock.Lock()
+	defer lcs.pendingLock.Unlock()
+
+	id := msg.ID
+	if id == 0 {
+		// a hook from an older version of DCS-BIOS does not send request ids,
+		// so its result can only be matched if a single request is waiting
+		if len(lcs.pending) > 1 {
+			fmt.Printf("luaconsole: cannot match a result without a request id to one of %d waiting requests\n", len(lcs.pending))
+			for pendingID, resultCh := range lcs.pending {
+				resultCh <- dcsReply{err: errResultWithoutID}
+				delete(lcs.pending, pendingID)
+			}
+			return
 		}
+		for pendingID := range lcs.pending {
+			id = pendingID
+		}
+	}
+	resultCh, ok := lcs.pending[id]
+	if !ok {
+		fmt.Printf("luaconsole: dropping result for request %d that is no longer waiting\n", msg.ID)
+		return
+	}
+	delete(lcs.pending, id)
+	resultCh <- dcsReply{result: LuaResult{
+		Type:   msg.Type,
+		Result: msg.Result,
+		Status: msg.Status,
+	}}
+}
+
+// failPendingRequests lets every request that is still waiting return err.
+func (lcs *LuaConsoleServer) failPendingRequests(err error) {
+	lcs.pendingLock.Lock()
+	defer lcs.pendingLock.Unlock()
+	for id, resultCh := range lcs.pending {
+		resultCh <- dcsReply{err: err}
+		delete(lcs.pending, id)
+	}
+}
+
+type CompleteSnippetRequest struct {
+	LuaEnvironment string `json:"luaEnvironment"`
+	SessionID      string `json:"sessionId,omitempty"`
+	// the code up to the cursor position
+	LuaCode string `json:"luaCode"`
+}
+
+// LuaCompletions lists the suggestions for the end of a snippet.
+// Each of them replaces LuaCode[ReplaceFrom:] (a byte offset).
+type LuaCompletions struct {
+	ReplaceFrom int      `json:"replaceFrom"`
+	Completions []string `json:"completions"`
+}
+
+// HandleCompleteSnippetRequest suggests globals, session locals and table
+// fields for the name at the end of a snippet. Completion is only available
+// in the "hub" environments; other environments return no suggestions.
+func (lcs *LuaConsoleServer) HandleCompleteSnippetRequest(req *CompleteSnippetRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+	if !gui.IsLuaConsoleEnabled() {
+		responseCh <- jsonapi.ErrorResult{Message: "The Lua Console is disabled.", Code: http.StatusForbidden}
+		return
+	}
+
+	scriptName, isHub := hubScriptName(req.LuaEnvironment)
+	if !isHub {
+		responseCh <- LuaCompletions{ReplaceFrom: len(req.LuaCode), Completions: make([]string, 0)}
+		return
+	}
+	replaceFrom, completions, err := luastate.CompleteConsoleInput(scriptName, req.SessionID, req.LuaCode)
+	if err != nil {
+		responseCh <- jsonapi.ErrorResult{Message: err.Error()}
+		return
+	}
+	responseCh <- LuaCompletions{ReplaceFrom: replaceFrom, Completions: completions}
+}
+
+type EndSessionRequest struct {
+	LuaEnvironment string `json:"luaEnvironment"`
+	SessionID      string `json:"sessionId"`
+}
+
+// HandleEndSessionRequest discards the local variables of a console session.
+func (lcs *LuaConsoleServer) HandleEndSessionRequest(req *EndSessionRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+	if scriptName, isHub := hubScriptName(req.LuaEnvironment); isHub {
+		luastate.EndConsoleSession(scriptName, req.SessionID)
 	}
+	responseCh <- jsonapi.SuccessResult{Message: "session ended"}
 }
@@ -0,0 +1,191 @@
+package luastate
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"dcs-bios.a10c.de/dcs-bios-hub/configstore"
+	"dcs-bios.a10c.de/dcs-bios-hub/exportdataparser"
+	"dcs-bios.a10c.de/dcs-bios-hub/jsonapi"
+)
+
+// activeAircraft is the value of MetadataStart/_ACFT_NAME in the most
+// recent frame from DCS. It is protected by luaLock.
+var activeAircraft string
+
+// activeScriptGroups lists the script groups that the user has activated.
+// It is protected by luaLock and persisted in scriptgroups.json.
+var activeScriptGroups []string
+
+// activationChanged is signalled when activeAircraft has changed.
+var activationChanged = make(chan struct{}, 1)
+
+// scriptGroupsFile is the configstore file that holds activeScriptGroups.
+const scriptGroupsFile = "scriptgroups.json"
+
+type scriptGroupsConfig struct {
+	ActiveGroups []string `json:"activeGroups"`
+}
+
+// loadActiveScriptGroups reads activeScriptGroups from the configstore.
+// The caller must hold luaLock.
+func loadActiveScriptGroups() {
+	var config scriptGroupsConfig
+	configstore.Load(scriptGroupsFile, &config)
+	activeScriptGroups = config.ActiveGroups
+}
+
+// inactiveReason returns why the activation conditions of the script
+// are not met, or the empty string if the script should run.
+// A script without conditions is always active. The caller must hold luaLock.
+func (entry *ScriptListEntry) inactiveReason() string {
+	if len(entry.Aircraft) > 0 && !containsFold(entry.Aircraft, activeAircraft) {
+		return "waiting for aircraft: " + strings.Join(entry.Aircraft, ", ")
+	}
+	if len(entry.Groups) > 0 {
+		for _, group := range entry.Groups {
+			if containsFold(activeScriptGroups, group) {
+				return ""
+			}
+		}
+		return "none of its groups is active: " + strings.Join(entry.Groups, ", ")
+	}
+	return ""
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateActiveAircraft is called for every frame from DCS. When the
+// aircraft changes, RunActivationUpdates is signalled to start or stop
+// the scripts whose activation conditions depend on it.
+func updateActiveAircraft(simData *exportdataparser.DataBuffer) {
+	if simData == nil {
+		return
+	}
+	aircraft := strings.TrimSpace(simData.GetCStringValue("MetadataStart/_ACFT_NAME"))
+
+	luaLock.Lock()
+	changed := aircraft != activeAircraft
+	activeAircraft = aircraft
+	luaLock.Unlock()
+
+	if changed {
+		select {
+		case activationChanged <- struct{}{}:
+		default: // an update is already pending
+		}
+	}
+}
+
+// RunActivationUpdates starts and stops scripts when the aircraft changes,
+// so the export data is not held up while scripts are loaded.
+// It returns when ctx is done.
+func RunActivationUpdates(ctx context.Context) {
+	for {
+		select {
+		case <-activationChanged:
+			applyActivationConditions(ioutil.Discard)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// applyActivationConditions starts the scripts whose activation conditions
+// are met and stops the others, see startScripts. Messages of the scripts
+// that are loaded are written to logBuffer.
+func applyActivationConditions(logBuffer io.Writer) {
+	luaLock.Lock()
+	loaded := scriptListLoaded
+	luaLock.Unlock()
+	if loaded {
+		startScripts(logBuffer)
+	}
+}
+
+type GetScriptActivationRequest struct{}
+
+// ScriptActivation describes the state that the activation
+// conditions of the scripts in the script list are checked against.
+type ScriptActivation struct {
+	// the value of _ACFT_NAME, empty if DCS is not sending data
+	Aircraft     string   `json:"aircraft"`
+	ActiveGroups []string `json:"activeGroups"`
+	// every group that is used in the script list
+	Groups []string `json:"groups"`
+}
+
+// scriptActivation returns the current ScriptActivation. The caller must hold luaLock.
+func scriptActivation() ScriptActivation {
+	activation := ScriptActivation{
+		Aircraft:     activeAircraft,
+		ActiveGroups: make([]string, 0, len(activeScriptGroups)),
+		Groups:       make([]string, 0),
+	}
+	activation.ActiveGroups = append(activation.ActiveGroups, activeScriptGroups...)
+	seen := make(map[string]bool)
+	for _, entry := range scriptList {
+		for _, group := range entry.Groups {
+			if !seen[group] {
+				seen[group] = true
+				activation.Groups = append(activation.Groups, group)
+			}
+		}
+	}
+	sort.Strings(activation.Groups)
+	return activation
+}
+
+func HandleGetScriptActivationRequest(req *GetScriptActivationRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+	luaLock.Lock()
+	defer luaLock.Unlock()
+	responseCh <- scriptActivation()
+}
+
+type SetActiveScriptGroupsRequest struct {
+	ActiveGroups []string `json:"activeGroups"`
+}
+
+// HandleSetActiveScriptGroupsRequest activates the given script groups,
+// deactivates all others and starts or stops scripts accordingly.
+func HandleSetActiveScriptGroupsRequest(req *SetActiveScriptGroupsRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+	luaLock.Lock()
+	activeScriptGroups = append([]string(nil), req.ActiveGroups...)
+	if persistentState {
+		if err := configstore.Store(scriptGroupsFile, scriptGroupsConfig{ActiveGroups: activeScriptGroups}); err != nil {
+			luaLock.Unlock()
+			responseCh <- jsonapi.ErrorResult{Message: "could not save the active script groups: " + err.Error()}
+			return
+		}
+	}
+	luaLock.Unlock()
+
+	logBuffer := bytes.NewBuffer([]byte{})
+	applyActivationConditions(logBuffer)
+
+	responseCh <- jsonapi.SuccessResult{
+		Message: logBuffer.String(),
+	}
+}
+
+func registerScriptActivationApiCalls(jsonAPI *jsonapi.JsonApi) {
+	jsonAPI.RegisterType("get_script_activation", GetScriptActivationRequest{})
+	jsonAPI.RegisterType("script_activation", ScriptActivation{})
+	jsonAPI.RegisterApiCall("get_script_activation", HandleGetScriptActivationRequest)
+
+	jsonAPI.RegisterType("set_active_script_groups", SetActiveScriptGroupsRequest{})
+	jsonAPI.RegisterApiCall("set_active_script_groups", HandleSetActiveScriptGroupsRequest)
+}
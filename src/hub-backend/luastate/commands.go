@@ -0,0 +1,114 @@
+package luastate
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// DefaultCommandQueueSize is the default number of commands from Lua
+// that can be queued for DCS or for the input callbacks.
+const DefaultCommandQueueSize = 64
+
+// InjectedCommand is a command that a script has injected with
+// hub.injectInputCommand. It is handled like a command from a panel.
+type InjectedCommand struct {
+	Source  string
+	Command string
+}
+
+// InjectedCommandChannel is used to pass commands injected by Lua to the input callbacks.
+// It is monitored in dcs-bios-hub.go.
+var InjectedCommandChannel = make(chan InjectedCommand, DefaultCommandQueueSize)
+
+// SetCommandQueueSize sets the size of SimCommandChannel and InjectedCommandChannel.
+// It must be called before the channels are used.
+func SetCommandQueueSize(size int) {
+	if size < 1 {
+		size = 1
+	}
+	SimCommandChannel = make(chan string, size)
+	InjectedCommandChannel = make(chan InjectedCommand, size)
+}
+
+// sendSimCommandSequence(commands, delay)
+// sends a list of commands to DCS in the background. Each command is a table
+// {cmd, arg, delay = ms}. The commands are sent delay milliseconds apart
+// (default 0); the delay field of a command overrides the delay before it.
+// Unlike sendSimCommand, the commands are never dropped when the queue is
+// full. The sequence is cancelled when the script is stopped.
+func (s *script) sendSimCommandSequence(L *lua.LState) int {
+	commands := L.CheckTable(1)
+	defaultDelay := time.Duration(float64(L.OptNumber(2, 0)) * float64(time.Millisecond))
+
+	type step struct {
+		command string
+		delay   time.Duration
+	}
+	steps := make([]step, 0, commands.Len())
+	for i := 1; i <= commands.Len(); i++ {
+		item, ok := commands.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			L.ArgError(1, "each command must be a table {cmd, arg}")
+		}
+		st := step{
+			command: lua.LVAsString(item.RawGetInt(1)) + " " + lua.LVAsString(item.RawGetInt(2)),
+			delay:   defaultDelay,
+		}
+		if d, ok := item.RawGetString("delay").(lua.LNumber); ok {
+			st.delay = time.Duration(float64(d) * float64(time.Millisecond))
+		}
+		if i == 1 && item.RawGetString("delay") == lua.LNil {
+			st.delay = 0
+		}
+		steps = append(steps, st)
+	}
+
+	done := s.done
+	go func() {
+		for _, st := range steps {
+			if st.delay > 0 {
+				select {
+				case <-time.After(st.delay):
+				case <-done:
+					return
+				}
+			}
+			select {
+			case SimCommandChannel <- st.command:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return 0
+}
+
+// injectInputCommand(cmd, arg, source)
+// passes a command to the input callbacks of all scripts as if it had been
+// sent by a panel. If no callback handles it, it is sent to DCS.
+// source defaults to "lua:<script file name>" ("lua:console" for the
+// Lua console). Returns false if the
+// command queue is full.
+func (s *script) injectInputCommand(L *lua.LState) int {
+	cmd := L.CheckString(1)
+	arg := L.CheckString(2)
+	defaultSource := "lua:console"
+	if s.path != "" {
+		defaultSource = "lua:" + filepath.Base(s.path)
+	}
+	source := L.OptString(3, defaultSource)
+	if strings.ContainsAny(cmd, " \n") || strings.Contains(arg, "\n") {
+		L.ArgError(1, "commands must not contain spaces or line breaks")
+	}
+
+	select {
+	case InjectedCommandChannel <- InjectedCommand{Source: source, Command: cmd + " " + arg}:
+		L.Push(lua.LTrue)
+	default:
+		L.Push(lua.LFalse)
+	}
+	return 1
+}
@@ -0,0 +1,416 @@
+package luastate
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// maxConsoleSessions is the number of console sessions that are kept for
+// each Lua state. When another session is started, the session that has
+// not been used for the longest time is discarded.
+const maxConsoleSessions = 16
+
+// maxCompletions limits the number of suggestions returned by CompleteConsoleInput.
+const maxCompletions = 100
+
+// A consoleSession keeps the local variables of a Lua console user
+// between snippets.
+//
+// Every session has its own environment table. Reading a name that is not
+// defined in the session falls through to the globals of the Lua state.
+// Top-level local declarations in a snippet are turned into assignments to
+// the session environment, so they are visible to later snippets of the same
+// session, but not to the script itself or to other sessions.
+type consoleSession struct {
+	env      *lua.LTable
+	locals   map[string]bool
+	lastUsed time.Time
+}
+
+// consoleSession returns the console session with the given id and creates
+// it if it does not exist yet. The caller must hold s.lock.
+func (s *script) consoleSession(id string) *consoleSession {
+	if sess, ok := s.sessions[id]; ok {
+		sess.lastUsed = time.Now()
+		return sess
+	}
+
+	if s.sessions == nil {
+		s.sessions = make(map[string]*consoleSession)
+	}
+	if len(s.sessions) >= maxConsoleSessions {
+		oldestID := ""
+		var oldest time.Time
+		for sessID, sess := range s.sessions {
+			if oldestID == "" || sess.lastUsed.Before(oldest) {
+				oldestID, oldest = sessID, sess.lastUsed
+			}
+		}
+		delete(s.sessions, oldestID)
+	}
+
+	sess := &consoleSession{
+		env:      s.L.NewTable(),
+		locals:   make(map[string]bool),
+		lastUsed: time.Now(),
+	}
+	globals := s.L.G.Global
+	mt := s.L.NewTable()
+	mt.RawSetString("__index", globals)
+	mt.RawSetString("__newindex", s.L.NewFunction(func(L *lua.LState) int {
+		env := L.CheckTable(1)
+		key := L.Get(2)
+		value := L.Get(3)
+		if name, ok := key.(lua.LString); ok && sess.locals[string(name)] {
+			env.RawSet(key, value)
+			return 0
+		}
+		L.SetTable(globals, key, value)
+		return 0
+	}))
+	s.L.SetMetatable(sess.env, mt)
+	s.sessions[id] = sess
+	return sess
+}
+
+// executeInSession executes a snippet of Lua code and returns all of its
+// return values as human readable strings. If the snippet is an expression,
+// its value is returned as if it had been prefixed with "return".
+// If sessionID is empty, the snippet is executed in the global environment
+// and local variables do not outlive it. The caller must hold s.lock.
+func (s *script) executeInSession(sessionID string, code string) ([]string, error) {
+	if s.isClosed() {
+		return nil, errScriptClosed
+	}
+
+	var sess *consoleSession
+	if sessionID != "" {
+		sess = s.consoleSession(sessionID)
+	}
+
+	fn, err := s.L.LoadString("return " + code)
+	if err != nil {
+		var locals []string
+		if sess != nil {
+			code, locals = rewriteTopLevelLocals(code)
+		}
+		fn, err = s.L.LoadString(code)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range locals {
+			sess.locals[name] = true
+		}
+	}
+	if sess != nil {
+		s.L.SetFEnv(fn, sess.env)
+	}
+
+	top := s.L.GetTop()
+	err = s.L.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    lua.MultRet,
+		Protect: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rets := make([]lua.LValue, s.L.GetTop()-top)
+	for i := range rets {
+		rets[i] = s.L.Get(top + 1 + i)
+	}
+	s.L.Pop(len(rets))
+
+	results := make([]string, 0, len(rets))
+	for _, ret := range rets {
+		str, err := s.serializeValue(ret)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, str)
+	}
+	return results, nil
+}
+
+// rewriteTopLevelLocals removes the "local" keyword from all local
+// declarations that are not nested in a block and returns the rewritten
+// code and the declared names. "local a, b" becomes "a, b = nil",
+// "local function f" becomes "function f".
+// If the code cannot be tokenized, it is returned unchanged.
+func rewriteTopLevelLocals(code string) (string, []string) {
+	code = strings.Replace(code, "\r\n", "\n", -1)
+	code = strings.Replace(code, "\r", "\n", -1)
+
+	lineStarts := []int{0}
+	for i, ch := range code {
+		if ch == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+	// offset returns the byte offset of a token position
+	offset := func(pos ast.Position) int {
+		return lineStarts[pos.Line-1] + pos.Column - 1
+	}
+
+	type token struct {
+		typ    int
+		str    string
+		offset int
+	}
+	var tokens []token
+	scanner := parse.NewScanner(strings.NewReader(code), "<console>")
+	lexer := &parse.Lexer{}
+	for {
+		tok, err := scanner.Scan(lexer)
+		if err != nil {
+			return code, nil
+		}
+		if tok.Type == parse.EOF {
+			break
+		}
+		lexer.PrevTokenType = tok.Type
+		tokens = append(tokens, token{typ: tok.Type, str: tok.Str, offset: offset(tok.Pos)})
+	}
+
+	type edit struct {
+		offset int
+		remove int
+		insert string
+	}
+	var edits []edit
+	var names []string
+	depth := 0
+	for i, tok := range tokens {
+		switch tok.typ {
+		case parse.TFunction, parse.TDo, parse.TIf, parse.TRepeat:
+			depth++
+		case parse.TEnd, parse.TUntil:
+			depth--
+		case parse.TLocal:
+			if depth != 0 || i+1 >= len(tokens) {
+				continue
+			}
+			edits = append(edits, edit{offset: tok.offset, remove: len("local")})
+			if tokens[i+1].typ == parse.TFunction {
+				if i+2 < len(tokens) && tokens[i+2].typ == parse.TIdent {
+					names = append(names, tokens[i+2].str)
+				}
+				continue
+			}
+			// local namelist ['=' explist]
+			j := i + 1
+			for j < len(tokens) && tokens[j].typ == parse.TIdent {
+				names = append(names, tokens[j].str)
+				if j+1 < len(tokens) && tokens[j+1].typ == ',' {
+					j += 2
+					continue
+				}
+				break
+			}
+			if j >= len(tokens) || tokens[j].typ != parse.TIdent {
+				continue // syntax error, leave it to the compiler
+			}
+			if j+1 >= len(tokens) || tokens[j+1].typ != '=' {
+				edits = append(edits, edit{offset: tokens[j].offset + len(tokens[j].str), insert: " = nil"})
+			}
+		}
+	}
+
+	var buf strings.Builder
+	prev := 0
+	for _, e := range edits {
+		buf.WriteString(code[prev:e.offset])
+		buf.WriteString(e.insert)
+		prev = e.offset + e.remove
+	}
+	buf.WriteString(code[prev:])
+	return buf.String(), names
+}
+
+// completionExpr matches the name or chain of table accesses
+// ("hub.get", "string.", "obj:me") at the end of the input.
+var completionExpr = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*(?:[.:][A-Za-z_][A-Za-z0-9_]*)*[.:]?$`)
+
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "if": true,
+	"in": true, "local": true, "nil": true, "not": true, "or": true,
+	"repeat": true, "return": true, "then": true, "true": true, "until": true,
+	"while": true,
+}
+
+// complete returns suggestions for the name or table access at the end of
+// code. replaceFrom is the byte offset in code where the completed
+// expression starts; every suggestion replaces code[replaceFrom:].
+// Only table fields and __index tables are inspected, no Lua code
+// (such as __index functions) is executed. The caller must hold s.lock.
+func (s *script) complete(sessionID string, code string) (replaceFrom int, completions []string) {
+	completions = make([]string, 0)
+	if s.isClosed() {
+		return len(code), completions
+	}
+
+	replaceFrom = len(code)
+	if loc := completionExpr.FindStringIndex(code); loc != nil {
+		replaceFrom = loc[0]
+	}
+	if replaceFrom > 0 && strings.HasSuffix(code[:replaceFrom], ".") && !strings.HasSuffix(code[:replaceFrom], "..") {
+		// the expression is a field of something we cannot resolve, e.g. f().x
+		return replaceFrom, completions
+	}
+	expr := code[replaceFrom:]
+
+	var base lua.LValue = s.L.G.Global
+	if sessionID != "" {
+		if sess, ok := s.sessions[sessionID]; ok {
+			base = sess.env
+		}
+	}
+	partial := expr
+	pathPrefix := ""
+	methodsOnly := false
+	if sep := strings.LastIndexAny(expr, ".:"); sep >= 0 {
+		partial = expr[sep+1:]
+		pathPrefix = expr[:sep+1]
+		methodsOnly = expr[sep] == ':'
+		for _, name := range strings.FieldsFunc(expr[:sep], func(r rune) bool { return r == '.' || r == ':' }) {
+			base = s.lookupField(base, name)
+		}
+	}
+
+	seen := make(map[string]bool)
+	s.forEachField(base, func(key string, value lua.LValue) {
+		if seen[key] || !strings.HasPrefix(key, partial) || !identifierRegexp.MatchString(key) || luaKeywords[key] {
+			return
+		}
+		if methodsOnly && value.Type() != lua.LTFunction {
+			return
+		}
+		seen[key] = true
+		completions = append(completions, pathPrefix+key)
+	})
+	sort.Strings(completions)
+	if len(completions) > maxCompletions {
+		completions = completions[:maxCompletions]
+	}
+	return replaceFrom, completions
+}
+
+// lookupField returns value[name] without calling any metamethods
+// other than __index tables.
+func (s *script) lookupField(value lua.LValue, name string) lua.LValue {
+	for depth := 0; depth < 8; depth++ {
+		tbl, ok := value.(*lua.LTable)
+		if !ok {
+			return lua.LNil
+		}
+		if v := tbl.RawGetString(name); v != lua.LNil {
+			return v
+		}
+		value = s.L.GetMetaField(tbl, "__index")
+	}
+	return lua.LNil
+}
+
+// forEachField calls fn for every string key of value and of its __index tables.
+// Keys of the table itself are visited before those of its __index tables.
+func (s *script) forEachField(value lua.LValue, fn func(key string, value lua.LValue)) {
+	for depth := 0; depth < 8; depth++ {
+		tbl, ok := value.(*lua.LTable)
+		if !ok {
+			return
+		}
+		tbl.ForEach(func(k, v lua.LValue) {
+			if key, ok := k.(lua.LString); ok {
+				fn(string(key), v)
+			}
+		})
+		value = s.L.GetMetaField(tbl, "__index")
+	}
+}
+
+// consoleTarget returns the Lua console if scriptName is empty
+// and the running script that matches scriptName otherwise.
+func consoleTarget(scriptName string) (*script, error) {
+	if scriptName == "" {
+		return console(), nil
+	}
+	s := findScriptByName(scriptName)
+	if s == nil {
+		return nil, fmt.Errorf("no running script matches %q", scriptName)
+	}
+	return s, nil
+}
+
+// ExecuteConsoleSnippet executes a snippet of Lua code in a console session
+// and returns all of its return values as human readable strings.
+// If scriptName is empty, the code runs in the Lua console, otherwise in the
+// running script that matches scriptName (see DoStringInScriptAndSerializeResult).
+// Local variables declared at the top level of the snippet are kept in the
+// session identified by sessionID. An empty sessionID executes the code
+// without a session.
+func ExecuteConsoleSnippet(scriptName string, sessionID string, code string) (results []string, err error) {
+	s, err := consoleTarget(scriptName)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isClosed() {
+		return nil, errScriptClosed
+	}
+	err = s.withTimeLimit(scriptTimeLimit, func() error {
+		var err error
+		results, err = s.executeInSession(sessionID, code)
+		return err
+	})
+	return results, err
+}
+
+// CompleteConsoleInput returns the names of globals, session locals and
+// table fields that complete the expression at the end of code.
+// Every suggestion replaces code[replaceFrom:].
+func CompleteConsoleInput(scriptName string, sessionID string, code string) (replaceFrom int, completions []string, err error) {
+	s, err := consoleTarget(scriptName)
+	if err != nil {
+		return 0, nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	replaceFrom, completions = s.complete(sessionID, code)
+	return replaceFrom, completions, nil
+}
+
+// EndConsoleSession discards the local variables of a console session.
+func EndConsoleSession(scriptName string, sessionID string) {
+	s, err := consoleTarget(scriptName)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, sessionID)
+}
+
+// ConsoleEnvironments returns the names of the Lua console environments of
+// the DCS-BIOS Hub: "hub" for the Lua console and "hub:<file name>" for
+// every running script.
+func ConsoleEnvironments() []string {
+	envs := []string{"hub"}
+	for _, s := range runningScriptsInOrder() {
+		if s.path != "" {
+			envs = append(envs, "hub:"+filepath.Base(s.path))
+		}
+	}
+	return envs
+}
@@ -0,0 +1,55 @@
+package luastate
+
+import (
+	"dcs-bios.a10c.de/dcs-bios-hub/controlreference"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ControlReferenceStore provides the control reference documentation
+// for hub.getControl and hub.listControls.
+// This will be set from dcs-bios-hub.go.
+var ControlReferenceStore *controlreference.ControlReferenceStore
+
+// getControl takes a "module/element" identifier and returns a table
+// describing the control (name, module, category, description, inputs
+// and outputs, using the field names of the control reference JSON files).
+// Returns nil if the control does not exist.
+func getControl(L *lua.LState) int {
+	id := L.CheckString(1)
+	if ControlReferenceStore == nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+	element := ControlReferenceStore.GetIOElementByIdentifier(id)
+	if element == nil {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(toLuaValue(L, *element))
+	return 1
+}
+
+// listControls takes a module name (e.g. "A-10C") and returns a list
+// of all controls in that module in the format used by getControl,
+// sorted by category and name. Returns an empty list if the module
+// does not exist.
+func listControls(L *lua.LState) int {
+	module := L.CheckString(1)
+	var elements []controlreference.IOElement
+	if ControlReferenceStore != nil {
+		elements = ControlReferenceStore.GetModuleIOElements(module)
+	}
+	list := L.CreateTable(len(elements), 0)
+	for _, element := range elements {
+		list.Append(toLuaValue(L, element))
+	}
+	L.Push(list)
+	return 1
+}
+
+// getActiveAircraft returns the name of the aircraft that is currently
+// active in DCS: World, or the empty string if there is none.
+func getActiveAircraft(L *lua.LState) int {
+	L.Push(lua.LString(currentSimData().GetCStringValue("MetadataStart/_ACFT_NAME")))
+	return 1
+}
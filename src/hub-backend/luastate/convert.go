@@ -0,0 +1,113 @@
+package luastate
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// toLuaValue converts a value to a Lua value by way of its JSON
+// representation, so Lua table keys match the JSON field names.
+// JSON arrays become Lua tables with indices starting at 1.
+func toLuaValue(L *lua.LState, value interface{}) lua.LValue {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return lua.LNil
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return lua.LNil
+	}
+	return jsonValueToLua(L, decoded)
+}
+
+// jsonValueToLua converts a value decoded by encoding/json into a Lua value.
+func jsonValueToLua(L *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		table := L.CreateTable(len(v), 0)
+		for _, item := range v {
+			table.Append(jsonValueToLua(L, item))
+		}
+		return table
+	case map[string]interface{}:
+		table := L.CreateTable(0, len(v))
+		for key, item := range v {
+			table.RawSetString(key, jsonValueToLua(L, item))
+		}
+		return table
+	}
+	return lua.LNil
+}
+
+// maxJsonValueDepth limits the nesting of tables converted by luaToJsonValue,
+// which also stops it on tables that contain themselves.
+const maxJsonValueDepth = 32
+
+// luaToJsonValue converts a Lua value into the types produced by encoding/json
+// when decoding into an interface{}, so it can be passed to jsonValueToLua later.
+// Tables whose keys are 1..n become arrays, other tables need string keys.
+func luaToJsonValue(value lua.LValue) (interface{}, error) {
+	return luaToJsonValueDepth(value, 0)
+}
+
+func luaToJsonValueDepth(value lua.LValue, depth int) (interface{}, error) {
+	switch v := value.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return nil, fmt.Errorf("%v cannot be stored", v)
+		}
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		if depth >= maxJsonValueDepth {
+			return nil, fmt.Errorf("tables are nested too deeply")
+		}
+		if n := v.Len(); n > 0 {
+			array := make([]interface{}, 0, n)
+			count := 0
+			v.ForEach(func(lua.LValue, lua.LValue) { count++ })
+			if count == n {
+				for i := 1; i <= n; i++ {
+					item, err := luaToJsonValueDepth(v.RawGetInt(i), depth+1)
+					if err != nil {
+						return nil, err
+					}
+					array = append(array, item)
+				}
+				return array, nil
+			}
+		}
+		object := make(map[string]interface{})
+		var err error
+		v.ForEach(func(key lua.LValue, item lua.LValue) {
+			if err != nil {
+				return
+			}
+			name, ok := key.(lua.LString)
+			if !ok {
+				err = fmt.Errorf("table keys must be strings, got %s", key.Type())
+				return
+			}
+			object[string(name)], err = luaToJsonValueDepth(item, depth+1)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return object, nil
+	}
+	return nil, fmt.Errorf("values of type %s cannot be stored", value.Type())
+}
@@ -2,51 +2,93 @@ package luastate
 
 import (
 	"strings"
+	"sync"
 
 	"dcs-bios.a10c.de/dcs-bios-hub/exportdataparser"
 
 	lua "github.com/yuin/gopher-lua"
 )
 
-// SimDataBuffer is a pointer to the DataBuffer that stores the most recent
-// cockpit state received from DCS: World.
-// This will be set from dcs-bios-hub.go.
-var SimDataBuffer *exportdataparser.DataBuffer
+// simDataBuffer is a pointer to the DataBuffer that stores the most recent
+// cockpit state received from DCS: World. It is replaced for every frame
+// and read by callbacks of timers and network connections, which run in
+// their own goroutines, so it is protected by simDataLock.
+var simDataBuffer *exportdataparser.DataBuffer
+var simDataLock sync.Mutex
+
+// SetSimDataBuffer replaces the cockpit state that hub scripts read.
+// It is called from dcs-bios-hub.go for every frame received from DCS: World.
+func SetSimDataBuffer(db *exportdataparser.DataBuffer) {
+	simDataLock.Lock()
+	defer simDataLock.Unlock()
+	simDataBuffer = db
+}
+
+// currentSimData returns the most recent cockpit state.
+func currentSimData() *exportdataparser.DataBuffer {
+	simDataLock.Lock()
+	defer simDataLock.Unlock()
+	return simDataBuffer
+}
 
 // ExportDataBuffer is a pointer to the DataBuffer that holds the data
 // sent to Arduino boards connected over serial ports.
-// This will be set from dcs-bios-hub.go.
+// This will be set from dcs-bios-hub.go. The buffer itself is safe
+// to write from callbacks of timers and network connections.
 var ExportDataBuffer *exportdataparser.DataBuffer
 
 // SimCommandChannel is used to send commands triggered by Lua.
 // It is monitored in dcs-bios-hub.go.
-var SimCommandChannel = make(chan string, 10)
+var SimCommandChannel = make(chan string, DefaultCommandQueueSize)
 
-var inputCallbacks []*lua.LFunction
-var outputCallbacks []*lua.LFunction
-
-// Loader is called by luastate.go to provide the "hub" module
-// to the Lua environment.
-func Loader(L *lua.LState) int {
+// hubModuleLoader is called by gopher-lua to provide the "hub" module
+// to the Lua state of a script.
+func (s *script) hubModuleLoader(L *lua.LState) int {
 	mod := L.SetFuncs(L.NewTable(), exports)
+	L.SetFuncs(mod, map[string]lua.LGFunction{
+		"registerInputCallback":  s.registerInputCallback,
+		"registerOutputCallback": s.registerExportDataCallback,
+		"setTimeout":             s.setTimeout,
+		"setInterval":            s.setInterval,
+		"clearTimer":             s.clearTimer,
+		"onSimValueChanged":      s.onSimValueChanged,
+		"defineOutput":           s.defineOutput,
+		"defineInput":            s.defineInput,
+		"sendSimCommandSequence": s.sendSimCommandSequence,
+		"injectInputCommand":     s.injectInputCommand,
+	})
+	L.SetField(mod, "store", s.storeModule(L))
 	L.Push(mod)
 	return 1
 }
 
+// exports are the functions of the "hub" module that do not depend on the script they are called from.
 var exports = map[string]lua.LGFunction{
-	"getSimString":           getSimString,
-	"getSimInteger":          getSimInteger,
-	"setPanelString":         setPanelString,
-	"setPanelInteger":        setPanelInteger,
-	"registerInputCallback":  registerInputCallback,
-	"registerOutputCallback": registerExportDataCallback,
-	"sendSimCommand":         sendSimCommand,
+	"getSimString":      getSimString,
+	"getSimInteger":     getSimInteger,
+	"setPanelString":    setPanelString,
+	"setPanelInteger":   setPanelInteger,
+	"sendSimCommand":    sendSimCommand,
+	"now":               now,
+	"getControl":        getControl,
+	"listControls":      listControls,
+	"getActiveAircraft": getActiveAircraft,
+	"getSimWord":        getSimWord,
+	"getPanelWord":      getPanelWord,
+	"setPanelWord":      setPanelWord,
+	"getSimBytes":       getSimBytes,
+	"setPanelBytes":     setPanelBytes,
+	"getSimBits":        getSimBits,
+	"setPanelBits":      setPanelBits,
 }
 
 // NotifyInputCallbacks passes the given command string to the
 // callbacks registered from Lua. Returns true if the command was
 // handled by a callback function and should not be passed on to DCS.
-func NotifyInputCallbacks(cmdString string) (handledByLua bool) {
+// Scripts are asked in reverse order of the script list, so the
+// last script in the list gets the first chance to handle a command.
+// source identifies the panel that sent the command (e.g. "COM3").
+func NotifyInputCallbacks(cmdString string, source string) (handledByLua bool) {
 	parts := strings.Split(cmdString, " ")
 	if len(parts) != 2 {
 		return false
@@ -54,35 +96,26 @@ func NotifyInputCallbacks(cmdString string) (handledByLua bool) {
 	cmd := parts[0]
 	arg := parts[1]
 
-	handledByLua = false
-	WithLuaStateDo(func(L *lua.LState) {
-		for _, cb := range inputCallbacks {
-			L.CallByParam(lua.P{
-				Fn:      cb,
-				NRet:    1,
-				Protect: true,
-			}, lua.LString(cmd), lua.LString(arg))
-			returnValue := L.Get(-1)
-			L.Pop(1)
-			if lua.LVAsBool(returnValue) {
-				handledByLua = true
-				return
-			}
+	scripts := runningScriptsInOrder()
+	for i := len(scripts) - 1; i >= 0; i-- {
+		handled, incidents := scripts[i].notifyInputCallbacks(cmd, arg, source)
+		reportIncidents(scripts[i], incidents)
+		if handled {
+			return true
 		}
-	})
-	return handledByLua
+	}
+	return false
 }
 
+// NotifyOutputCallbacks calls the value change callbacks and
+// the output callbacks of all scripts in the order of the script list.
+// Before that, scripts are started or stopped if the aircraft has changed.
 func NotifyOutputCallbacks() {
-	WithLuaStateDo(func(L *lua.LState) {
-		for _, cb := range outputCallbacks {
-			L.CallByParam(lua.P{
-				Fn:      cb,
-				NRet:    0,
-				Protect: true,
-			})
-		}
-	})
+	simData := currentSimData()
+	updateActiveAircraft(simData)
+	for _, s := range runningScriptsInOrder() {
+		reportIncidents(s, s.notifyOutputCallbacks(simData))
+	}
 }
 
 // getSimString takes a "module/element" identifier
@@ -91,7 +124,7 @@ func NotifyOutputCallbacks() {
 // successful (e.g. the identifier was not found).
 func getSimString(L *lua.LState) int {
 	id := L.ToString(1)
-	value := SimDataBuffer.GetCStringValue(id)
+	value := currentSimData().GetCStringValue(id)
 	L.Push(lua.LString(value))
 	return 1
 }
@@ -102,7 +135,7 @@ func getSimString(L *lua.LState) int {
 // successful (e.g. the identifier was not found).
 func getSimInteger(L *lua.LState) int {
 	id := L.ToString(1)
-	value := SimDataBuffer.GetIntegerValue(id)
+	value := currentSimData().GetIntegerValue(id)
 	L.Push(lua.LNumber(value))
 	return 1
 }
@@ -138,9 +171,8 @@ func setPanelInteger(L *lua.LState) int {
 }
 
 // sendSimCommand(cmd, arg)
-// queues a command to be sent to DCS. The command buffer
-// holds 10 commands. If the command does not fit, returns false
-// and ignores the command.
+// queues a command to be sent to DCS. If the command queue
+// is full, returns false and ignores the command.
 func sendSimCommand(L *lua.LState) int {
 	cmd := L.ToString(1)
 	arg := L.ToString(2)
@@ -157,13 +189,13 @@ func sendSimCommand(L *lua.LState) int {
 
 // registerInputCallback registers a function to be called
 // whenever a command arrives from the physical panels.
-// The function will be called with two arguments: command, argument
+// The function will be called with three arguments: command, argument, source
 // If the function returns true, the command will not be passed on to DCS
 // or to other callback functions.
-func registerInputCallback(L *lua.LState) int {
+func (s *script) registerInputCallback(L *lua.LState) int {
 	fn := L.ToFunction(1)
 	// insert new callback before all others
-	inputCallbacks = append([]*lua.LFunction{fn}, inputCallbacks...)
+	s.inputCallbacks = append([]*lua.LFunction{fn}, s.inputCallbacks...)
 	return 0
 }
 
@@ -171,8 +203,8 @@ func registerInputCallback(L *lua.LState) int {
 // every time new export data is available.
 // This function can use hub.getSimString() and hub.setPanelString()
 // to remap export data.
-func registerExportDataCallback(L *lua.LState) int {
+func (s *script) registerExportDataCallback(L *lua.LState) int {
 	fn := L.ToFunction(1)
-	outputCallbacks = append(outputCallbacks, fn)
+	s.outputCallbacks = append(s.outputCallbacks, fn)
 	return 0
 }
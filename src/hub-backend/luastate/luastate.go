@@ -1,166 +1,320 @@
-// Package luastate holds the central LuaState for user scripting
-// and provides a goroutine-safe API to access it.
+// Package luastate runs user scripts, each in its own Lua state,
+// and provides a goroutine-safe API to access them.
 package luastate
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
 	"sync"
 	"time"
 
 	"dcs-bios.a10c.de/dcs-bios-hub/configstore"
 	"dcs-bios.a10c.de/dcs-bios-hub/jsonapi"
-	"dcs-bios.a10c.de/dcs-bios-hub/luastate/shmmodule"
-	"github.com/nubix-io/gluabit32"
 	lua "github.com/yuin/gopher-lua"
 )
 
-var luaState = lua.NewState()
+// luaLock protects scriptList, runningScripts, consoleScript and scriptListSubscriptions.
+// The Lua state of each script is protected by the lock of that script.
+// luaLock must not be acquired while holding the lock of a script.
 var luaLock sync.Mutex
 
+// Values for ScriptListEntry.State
+const (
+	ScriptStateRunning  = "running"
+	ScriptStateError    = "error"
+	ScriptStateDisabled = "disabled"
+	// the activation conditions of the script are not met
+	ScriptStateInactive = "inactive"
+)
+
 type ScriptListEntry struct {
 	Path    string `json:"path"`
 	Enabled bool   `json:"enabled"`
+	// Plugin is the name of the plugin that provides the script,
+	// or empty if the script has been added by the user.
+	Plugin string `json:"plugin,omitempty"`
+	// Aircraft and Groups are the activation conditions of the script.
+	// If Aircraft is not empty, the script only runs while one of the
+	// listed aircraft (as in _ACFT_NAME) is active. If Groups is not empty,
+	// the script only runs while at least one of its groups is active.
+	Aircraft []string `json:"aircraft,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+	// State and Error describe the runtime status of the script.
+	// They are not persisted in scriptlist.json.
+	State string `json:"state,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Incidents lists the callbacks that have been disabled since
+	// the script was loaded because they exceeded their time limit.
+	Incidents []string `json:"incidents,omitempty"`
 }
 
 var scriptList []ScriptListEntry
 
+// scriptListVersion is incremented whenever the script list is replaced,
+// so scripts that have been loaded for the previous list are not started.
+// It is protected by luaLock.
+var scriptListVersion = 0
+
+// runningScripts maps the path of each loaded script to its Lua state.
+var runningScripts = make(map[string]*script)
+
+// consoleScript is the Lua state used by the "hub" environment of the Lua console.
+var consoleScript = newScript("")
+
 var scriptListSubscriptions map[chan []ScriptListEntry]bool = make(map[chan []ScriptListEntry]bool)
 
-// Reset creates a new Lua state and executes all user lua scripts
+// Reset stops all user scripts, creates a new Lua state for each one
+// and executes all enabled scripts from scriptlist.json and
+// the scripts provided by plugins.
 func Reset(logBuffer io.Writer) {
+	luaLock.Lock()
+	for path, s := range runningScripts {
+		s.close()
+		delete(runningScripts, path)
+	}
+	consoleScript.close()
+	consoleScript = newScript("")
+
+	scriptList = nil
+	configstore.Load("scriptlist.json", &scriptList)
+	loadActiveScriptGroups()
+	// plugins have been loaded before, so scripts of plugins
+	// that are not loaded now belong to plugins that have been removed
+	mergePluginScripts(true)
+	scriptListLoaded = true
+	scriptListVersion++
+	notifyScriptListSubscribers()
+	luaLock.Unlock()
+
+	startScripts(logBuffer)
+}
+
+// Close stops all user scripts and releases their Lua states.
+// It is called when the DCS-BIOS Hub shuts down.
+func Close() {
 	luaLock.Lock()
 	defer luaLock.Unlock()
 
-	shmmodule.Reset()
-
-	luaState.Close()
-	inputCallbacks = nil
-	outputCallbacks = nil
-
-	luaState = lua.NewState()
-	luaState.PreloadModule("hub", Loader)
-	shmmodule.Preload(luaState)
-	gluabit32.Preload(luaState)
-	err := luaState.DoString(`hub = require("hub")
-local _FILEENV = {}
-function setFileEnv(name, env)
-	_FILEENV[name] = env
-end
-function enterEnv(name)
-	for filename, env in pairs(_FILEENV) do
-		if filename:sub(filename:len() - name:len() + 1):lower() == name:lower() then
-			setfenv(2, env)
-			return true
-		end
-	end
-	return false
-end`)
+	for path, s := range runningScripts {
+		s.close()
+		delete(runningScripts, path)
+	}
+	consoleScript.close()
+	flushScriptStores()
+}
+
+// needsStart returns true if the script described by entry may run and
+// is not running. Otherwise, it updates entry.State and entry.Error and
+// stops the script if its activation conditions are no longer met.
+// The caller must hold luaLock.
+func needsStart(entry *ScriptListEntry) bool {
+	if !entry.Enabled {
+		entry.State = ScriptStateDisabled
+		entry.Error = ""
+		return false
+	}
+	if entry.Plugin != "" && !isPluginLoaded(entry.Plugin) {
+		entry.State = ScriptStateDisabled
+		entry.Error = "the plugin " + entry.Plugin + " is not loaded"
+		return false
+	}
+	if reason := entry.inactiveReason(); reason != "" {
+		stopScript(entry.Path)
+		entry.State = ScriptStateInactive
+		entry.Error = reason
+		entry.Incidents = nil
+		return false
+	}
+	_, running := runningScripts[entry.Path]
+	return !running
+}
+
+// startScripts starts the scripts in the script list that needsStart
+// returns true for, which also stops the scripts whose activation conditions
+// are no longer met. The scripts are loaded without holding luaLock, so the
+// other scripts keep running in the meantime, and swapped in if they should
+// still run and the script list has not been replaced when loading is done.
+// The caller must not hold luaLock.
+func startScripts(logBuffer io.Writer) {
+	luaLock.Lock()
+	version := scriptListVersion
+	changed := false
+	var paths []string
+	for i := range scriptList {
+		entry := &scriptList[i]
+		prevState, prevError := entry.State, entry.Error
+		if needsStart(entry) {
+			paths = append(paths, entry.Path)
+		}
+		if entry.State != prevState || entry.Error != prevError {
+			changed = true
+		}
+	}
+	luaLock.Unlock()
+
+	type loadResult struct {
+		s   *script
+		err error
+	}
+	loaded := make(map[string]loadResult, len(paths))
+	for _, path := range paths {
+		s, err := loadScript(path, logBuffer)
+		loaded[path] = loadResult{s, err}
+	}
+
+	luaLock.Lock()
+	defer luaLock.Unlock()
+	for path, result := range loaded {
+		entry := findScriptListEntry(path)
+		if entry != nil && version == scriptListVersion && needsStart(entry) {
+			setRunningScript(entry, result.s, result.err)
+		} else if result.s != nil {
+			// the script list or the activation conditions have changed
+			// or the script has been started elsewhere in the meantime
+			result.s.close()
+		}
+	}
+	if changed || len(loaded) > 0 {
+		notifyScriptListSubscribers()
+	}
+}
+
+// setRunningScript replaces the running instance of the script described
+// by entry with s, which has been loaded with the result err.
+// The caller must hold luaLock.
+func setRunningScript(entry *ScriptListEntry, s *script, err error) {
+	stopScript(entry.Path)
+	entry.Incidents = nil
+	if s != nil {
+		// keep the callbacks that were registered before the error occurred
+		runningScripts[entry.Path] = s
+	}
 	if err != nil {
-		panic(err)
+		entry.State = ScriptStateError
+		entry.Error = err.Error()
+		return
 	}
+	entry.State = ScriptStateRunning
+	entry.Error = ""
+}
 
-	configstore.Load("scriptlist.json", &scriptList)
+// stopScript closes the Lua state of the script at path if it is running.
+// The caller must hold luaLock.
+func stopScript(path string) {
+	if s, ok := runningScripts[path]; ok {
+		s.close()
+		delete(runningScripts, path)
+	}
+}
+
+// ReloadScript stops a single script and executes it again in a new Lua state,
+// without affecting any other script.
+func ReloadScript(path string, logBuffer io.Writer) error {
+	luaLock.Lock()
+	entry := findScriptListEntry(path)
+	if entry == nil {
+		luaLock.Unlock()
+		return fmt.Errorf("not in script list: %s", path)
+	}
+	stopScript(path)
+	start := needsStart(entry)
+	version := scriptListVersion
+	luaLock.Unlock()
+
+	var s *script
+	var err error
+	if start {
+		// load the script without holding luaLock,
+		// so other scripts are not blocked while it is executed
+		s, err = loadScript(path, logBuffer)
+	}
+
+	luaLock.Lock()
+	defer luaLock.Unlock()
+	defer notifyScriptListSubscribers()
 
-	for _, script := range scriptList {
-		if !script.Enabled {
-			continue
+	entry = findScriptListEntry(path)
+	if entry == nil {
+		if s != nil {
+			s.close()
 		}
+		return fmt.Errorf("not in script list: %s", path)
+	}
+	if start {
+		if version == scriptListVersion && needsStart(entry) {
+			setRunningScript(entry, s, err)
+		} else if s != nil {
+			// the script list has changed or the script
+			// has been started elsewhere in the meantime
+			s.close()
+		}
+	}
+	if entry.State == ScriptStateError {
+		return errors.New(entry.Error)
+	}
+	return nil
+}
 
-		stat, err := os.Stat(script.Path)
-		if err != nil || stat.IsDir() {
-			fmt.Fprintf(logBuffer, "file not found: %s\n", script.Path)
-			continue
+// findScriptListEntry returns the entry for path, or nil if the path
+// is not in the script list. The caller must hold luaLock.
+func findScriptListEntry(path string) *ScriptListEntry {
+	for i := range scriptList {
+		if scriptList[i].Path == path {
+			return &scriptList[i]
 		}
+	}
+	return nil
+}
 
-		fmt.Fprintf(logBuffer, "loading: %s\n", script.Path)
-		scriptDir := filepath.Dir(script.Path) + string(os.PathSeparator)
+// runningScriptsInOrder returns the Lua console followed by all running
+// scripts in the order of the script list.
+func runningScriptsInOrder() []*script {
+	luaLock.Lock()
+	defer luaLock.Unlock()
 
-		err = luaState.DoString(`
-		local path=[[` + script.Path + `]]
-		local newgt = {}
-		newgt["_G"] = newgt
-		newgt["_SCRIPTDIR"] = [[` + scriptDir + `]]
-		
-		for _, varname in pairs({
-			"package",
-			"_VERSION",
-			"_GOPHER_LUA_VERSION",
-			"next",
-			"getfenv",
-			"setfenv",
-			"setmetatable",
-			"unpack",
-			"rawget",
-			"select",
-			"assert",
-			"loadfile",
-			"require",
-			"getmetatable",
-			"print",
-			"type",
-			"dofile",
-			"error",
-			"load",
-			"xpcall",
-			"tonumber",
-			"rawequal",
-			"rawset",
-			"setfenv",
-			"tostring",
-			"module",
-			"loadstring",
-			"pcall",
-			"ipairs",
-			"pairs",
-			"table",
-			"io",
-			"os",
-			"string",
-			"math",
-			"debug",
-			"channel",
-			"coroutine",
-			"hub"
-		}) do newgt[varname] = _G[varname] end
-
-		newgt["loadstring"] = function(s)
-			local f, err = loadstring(s)
-			if f == nil then
-				return f, err
-			end
-			setfenv(f, newgt)
-			return f, err
-		end
-		newgt["loadfile"] = function(path)
-			local f, err = loadfile(path)
-			if f == nil then
-				return f, err
-			end
-			setfenv(f, newgt)
-			return f, err
-		end
-		newgt["dofile"] = function(path)
-			local f, err = newgt["loadfile"](path)
-			if err ~= nil then error(err) end
-			return f()
-		end
+	scripts := make([]*script, 0, len(runningScripts)+1)
+	scripts = append(scripts, consoleScript)
+	for _, entry := range scriptList {
+		if s, ok := runningScripts[entry.Path]; ok {
+			scripts = append(scripts, s)
+		}
+	}
+	return scripts
+}
 
-		local f = loadfile(path)
-		setFileEnv(path:lower(), newgt)
-		setfenv(f, newgt)
-		f()
-		`)
-		if err != nil {
-			fmt.Fprintf(logBuffer, "lua error: %v\n", err)
+// findScriptByName returns the running script whose path ends with name
+// (case insensitive), or nil if there is none.
+func findScriptByName(name string) *script {
+	for _, s := range runningScriptsInOrder() {
+		if s.matchesName(name) {
+			return s
 		}
 	}
-	luaState.Options.IncludeGoStackTrace = true
+	return nil
+}
+
+// reportIncidents adds incidents that occurred while running
+// callbacks of s to the script list entry of s.
+func reportIncidents(s *script, incidents []string) {
+	if len(incidents) == 0 {
+		return
+	}
+	for _, incident := range incidents {
+		logScriptMessage(s.path, ScriptLogLevelError, incident)
+	}
 
+	luaLock.Lock()
+	defer luaLock.Unlock()
+	entry := findScriptListEntry(s.path)
+	if entry == nil || runningScripts[s.path] != s {
+		// the script has been stopped in the meantime
+		return
+	}
+	entry.Incidents = append(entry.Incidents, incidents...)
+	notifyScriptListSubscribers()
 }
 
 type ReloadHooksLuaRequest struct{}
@@ -175,32 +329,56 @@ func HandleReloadHooksLuaRequest(req *ReloadHooksLuaRequest, responseCh chan<- i
 	}
 }
 
+type ReloadScriptRequest struct {
+	Path string `json:"path"`
+}
+
+func HandleReloadScriptRequest(req *ReloadScriptRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+
+	logBuffer := bytes.NewBuffer([]byte{})
+	if err := ReloadScript(req.Path, logBuffer); err != nil {
+		responseCh <- jsonapi.ErrorResult{
+			Message: err.Error() + "\n" + logBuffer.String(),
+		}
+		return
+	}
+	responseCh <- jsonapi.SuccessResult{
+		Message: logBuffer.String(),
+	}
+}
+
 type MonitorScriptListRequest struct{}
 type ScriptList []ScriptListEntry
 
-func HandleMonitorScriptListRequest(req *MonitorScriptListRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+func HandleMonitorScriptListRequest(ctx context.Context, req *MonitorScriptListRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+
 	subscription := make(chan []ScriptListEntry)
-	go func() {
-		for s := range subscription {
-			select {
-			case responseCh <- ScriptList(s):
-			case _, ok := <-followupCh:
-				if !ok {
-					luaLock.Lock()
-					defer luaLock.Unlock()
-					delete(scriptListSubscriptions, subscription)
-					return
-				}
-			}
-		}
-		close(responseCh)
-	}()
 	luaLock.Lock()
 	scriptListSubscriptions[subscription] = true
-	listCopy := make([]ScriptListEntry, len(scriptList))
-	copy(listCopy, scriptList)
-	subscription <- listCopy
+	list := make([]ScriptListEntry, len(scriptList))
+	copy(list, scriptList)
 	luaLock.Unlock()
+
+	defer func() {
+		luaLock.Lock()
+		delete(scriptListSubscriptions, subscription)
+		luaLock.Unlock()
+	}()
+
+	for {
+		select {
+		case responseCh <- ScriptList(list):
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case list = <-subscription:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
 // notifyScriptListSubscribers sends a copy of the UserLuaScript list to all subscribers.
@@ -216,44 +394,104 @@ func notifyScriptListSubscribers() {
 	}
 }
 
+// storeScriptList writes the script list to scriptlist.json.
+// The caller must hold luaLock.
+func storeScriptList() {
+	persisted := make([]ScriptListEntry, len(scriptList))
+	for i, entry := range scriptList {
+		persisted[i] = ScriptListEntry{
+			Path:     entry.Path,
+			Enabled:  entry.Enabled,
+			Plugin:   entry.Plugin,
+			Aircraft: entry.Aircraft,
+			Groups:   entry.Groups,
+		}
+	}
+	configstore.Store("scriptlist.json", persisted)
+}
+
 type SetScriptListRequest ScriptList
 
+// HandleSetScriptListRequest replaces the script list, including the order
+// and the activation conditions of the scripts. Scripts that have been
+// removed, disabled or deactivated are stopped and scripts that have been
+// enabled or activated are started. Scripts that keep running are not reloaded.
 func HandleSetScriptListRequest(req *SetScriptListRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
 	defer close(responseCh)
 	luaLock.Lock()
-	defer luaLock.Unlock()
+
+	previousList := make(map[string]ScriptListEntry)
+	for _, entry := range scriptList {
+		previousList[entry.Path] = entry
+	}
 
 	scriptList = nil
 	for _, item := range *req {
-		scriptList = append(scriptList, item)
+		entry := ScriptListEntry{
+			Path:     item.Path,
+			Enabled:  item.Enabled,
+			Plugin:   pluginOwningScript(item.Path),
+			Aircraft: item.Aircraft,
+			Groups:   item.Groups,
+		}
+		if prev, ok := previousList[item.Path]; ok && entry.Plugin == "" {
+			entry.Plugin = prev.Plugin
+		}
+		if prev, ok := previousList[item.Path]; ok && prev.Enabled && item.Enabled {
+			entry.State = prev.State
+			entry.Error = prev.Error
+			entry.Incidents = prev.Incidents
+		}
+		scriptList = append(scriptList, entry)
 	}
+
+	for path := range runningScripts {
+		if entry := findScriptListEntry(path); entry == nil || !entry.Enabled {
+			stopScript(path)
+		}
+	}
+	scriptListVersion++
 	notifyScriptListSubscribers()
-	configstore.Store("scriptlist.json", scriptList)
+	storeScriptList()
+	luaLock.Unlock()
+
+	logBuffer := bytes.NewBuffer([]byte{})
+	startScripts(logBuffer)
 
-	responseCh <- jsonapi.SuccessResult{}
+	responseCh <- jsonapi.SuccessResult{
+		Message: logBuffer.String(),
+	}
 }
 
 func RegisterJsonApiCalls(jsonAPI *jsonapi.JsonApi) {
 	jsonAPI.RegisterType("reload_scripts", ReloadHooksLuaRequest{})
 	jsonAPI.RegisterApiCall("reload_scripts", HandleReloadHooksLuaRequest)
 
+	jsonAPI.RegisterType("reload_script", ReloadScriptRequest{})
+	jsonAPI.RegisterApiCall("reload_script", HandleReloadScriptRequest)
+
 	jsonAPI.RegisterType("monitor_script_list", MonitorScriptListRequest{})
-	jsonAPI.RegisterApiCall("monitor_script_list", HandleMonitorScriptListRequest)
+	jsonAPI.RegisterStreamingApiCall("monitor_script_list", HandleMonitorScriptListRequest)
 	jsonAPI.RegisterType("script_list", ScriptList(nil))
 
 	jsonAPI.RegisterType("set_script_list", SetScriptListRequest{})
 	jsonAPI.RegisterApiCall("set_script_list", HandleSetScriptListRequest)
+
+	registerScriptLogApiCalls(jsonAPI)
+	registerScriptStoreApiCalls(jsonAPI)
+	registerScriptTestApiCalls(jsonAPI)
+	registerScriptActivationApiCalls(jsonAPI)
 }
 
-// DoString executes a snippet of Lua code in the environment.
-// If the code throws an error or cannot be parsed, the function
-// returns the error. On success, nil is returned.
-func DoString(code string) error {
-	luaLock.Lock()
-	defer luaLock.Unlock()
+// doString executes a snippet of Lua code in the Lua state of the script.
+// The caller must hold s.lock.
+func (s *script) doString(code string) error {
+	if s.isClosed() {
+		return errScriptClosed
+	}
 
-	err := luaState.CallByParam(lua.P{
-		Fn:      luaState.GetGlobal("loadstring"),
+	err := s.L.CallByParam(lua.P{
+		Fn:      s.L.GetGlobal("loadstring"),
 		NRet:    1,
 		Protect: true,
 	}, lua.LString(code))
@@ -262,14 +500,14 @@ func DoString(code string) error {
 		return err
 	}
 
-	loadstringReturn := luaState.Get(-1)
-	luaState.Pop(1)
+	loadstringReturn := s.L.Get(-1)
+	s.L.Pop(1)
 
 	if loadstringReturn.Type() != lua.LTFunction {
 		return errors.New(loadstringReturn.String())
 	}
 
-	err = luaState.CallByParam(lua.P{
+	err = s.L.CallByParam(lua.P{
 		Fn:      loadstringReturn,
 		NRet:    0,
 		Protect: true,
@@ -281,31 +519,32 @@ func DoString(code string) error {
 	return nil
 }
 
-// DoStringAndSerializeResult executes a block of Lua code,
-// and returns the Lua return value as a human readable string.
-func DoStringAndSerializeResult(code string) (string, error) {
-	luaLock.Lock()
-	defer luaLock.Unlock()
+// doStringAndSerializeResult executes a block of Lua code in the Lua state
+// of the script and returns the Lua return value as a human readable string.
+// The caller must hold s.lock.
+func (s *script) doStringAndSerializeResult(code string) (string, error) {
+	if s.isClosed() {
+		return "", errScriptClosed
+	}
 
-	err := luaState.CallByParam(lua.P{
-		Fn:      luaState.GetGlobal("loadstring"),
+	err := s.L.CallByParam(lua.P{
+		Fn:      s.L.GetGlobal("loadstring"),
 		NRet:    1,
 		Protect: true,
 	}, lua.LString(code))
 
-	// err := luaState.DoString(code)
 	if err != nil {
 		return "", err
 	}
 
-	loadstringReturn := luaState.Get(-1)
-	luaState.Pop(1)
+	loadstringReturn := s.L.Get(-1)
+	s.L.Pop(1)
 
 	if loadstringReturn.Type() != lua.LTFunction {
 		return "", errors.New(loadstringReturn.String())
 	}
 
-	err = luaState.CallByParam(lua.P{
+	err = s.L.CallByParam(lua.P{
 		Fn:      loadstringReturn,
 		NRet:    1,
 		Protect: true,
@@ -314,22 +553,26 @@ func DoStringAndSerializeResult(code string) (string, error) {
 		return "", err
 	}
 
-	ret := luaState.Get(-1)
-	luaState.Pop(1)
+	ret := s.L.Get(-1)
+	s.L.Pop(1)
 
-	// convert to string
+	return s.serializeValue(ret)
+}
 
-	table := luaState.NewTable()
+// serializeValue converts a Lua value to a human readable string.
+// Tables are printed recursively. The caller must hold s.lock.
+func (s *script) serializeValue(ret lua.LValue) (string, error) {
+	table := s.L.NewTable()
 	table.RawSet(lua.LString("svalue"), ret)
-	table.RawSetString("table", luaState.GetGlobal("table"))
-	table.RawSetString("print", luaState.GetGlobal("print"))
-	table.RawSetString("tostring", luaState.GetGlobal("tostring"))
-	table.RawSetString("string", luaState.GetGlobal("string"))
-	table.RawSetString("type", luaState.GetGlobal("type"))
-	table.RawSetString("pairs", luaState.GetGlobal("pairs"))
-
-	err = luaState.CallByParam(lua.P{
-		Fn:      luaState.GetGlobal("loadstring"),
+	table.RawSetString("table", s.L.GetGlobal("table"))
+	table.RawSetString("print", s.L.GetGlobal("print"))
+	table.RawSetString("tostring", s.L.GetGlobal("tostring"))
+	table.RawSetString("string", s.L.GetGlobal("string"))
+	table.RawSetString("type", s.L.GetGlobal("type"))
+	table.RawSetString("pairs", s.L.GetGlobal("pairs"))
+
+	err := s.L.CallByParam(lua.P{
+		Fn:      s.L.GetGlobal("loadstring"),
 		NRet:    1,
 		Protect: true,
 	}, lua.LString(`
@@ -368,59 +611,124 @@ func DoStringAndSerializeResult(code string) (string, error) {
 	local stringResult = table.concat(retlist)
 	return stringResult
 	`))
-	serializeFunction := luaState.Get(-1)
-	luaState.Pop(1)
+	serializeFunction := s.L.Get(-1)
+	s.L.Pop(1)
 
 	if serializeFunction.Type() != lua.LTFunction {
 		panic("not a function: " + serializeFunction.String())
 	}
 
-	luaState.SetFEnv(serializeFunction, table)
+	s.L.SetFEnv(serializeFunction, table)
 
-	err = luaState.CallByParam(lua.P{
+	err = s.L.CallByParam(lua.P{
 		Fn:      serializeFunction,
 		Protect: true,
 		NRet:    1,
 	})
 
 	if err != nil {
-		panic(err.Error())
+		return "", err
 	}
-	ret = luaState.Get(-1)
-	luaState.Pop(1)
+	ret = s.L.Get(-1)
+	s.L.Pop(1)
 
 	return ret.String(), nil
 }
 
-// DoFile executes a .lua file given a path to the file.
-func DoFile(path string) error {
+// errScriptClosed is returned when code is executed in a script
+// that has been stopped in the meantime.
+var errScriptClosed = errors.New("the script has been stopped")
+
+// DoString executes a snippet of Lua code in the environment of the Lua console.
+// If the code throws an error or cannot be parsed, the function
+// returns the error. On success, nil is returned.
+func DoString(code string) error {
+	s := console()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isClosed() {
+		return errScriptClosed
+	}
+	return s.withTimeLimit(scriptTimeLimit, func() error {
+		return s.doString(code)
+	})
+}
+
+// DoStringAndSerializeResult executes a block of Lua code in the environment
+// of the Lua console and returns the Lua return value as a human readable string.
+func DoStringAndSerializeResult(code string) (string, error) {
+	return console().doStringWithTimeLimitAndSerializeResult(code)
+}
+
+// DoStringInScriptAndSerializeResult works like DoStringAndSerializeResult,
+// but executes the code in the Lua state of a running script.
+// The script is identified by the end of its path, e.g. "myscript.lua".
+func DoStringInScriptAndSerializeResult(scriptName string, code string) (string, error) {
+	s := findScriptByName(scriptName)
+	if s == nil {
+		return "", fmt.Errorf("no running script matches %q", scriptName)
+	}
+	return s.doStringWithTimeLimitAndSerializeResult(code)
+}
+
+// doStringWithTimeLimitAndSerializeResult calls doStringAndSerializeResult
+// and aborts the code if it does not finish within scriptTimeLimit.
+func (s *script) doStringWithTimeLimitAndSerializeResult(code string) (result string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isClosed() {
+		return "", errScriptClosed
+	}
+	err = s.withTimeLimit(scriptTimeLimit, func() error {
+		var err error
+		result, err = s.doStringAndSerializeResult(code)
+		return err
+	})
+	return result, err
+}
+
+// console returns the Lua state of the Lua console.
+func console() *script {
 	luaLock.Lock()
 	defer luaLock.Unlock()
-	return luaState.DoFile(path)
+	return consoleScript
+}
+
+// DoFile executes a .lua file in the environment of the Lua console.
+func DoFile(path string) error {
+	s := console()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isClosed() {
+		return errScriptClosed
+	}
+	return s.L.DoFile(path)
 }
 
-// SetGlobal sets a global variable in the Lua state.
+// SetGlobal sets a global variable in the Lua state of the Lua console.
 func SetGlobal(name string, value lua.LValue) {
-	luaLock.Lock()
-	defer luaLock.Unlock()
-	luaState.SetGlobal(name, value)
+	WithLuaStateDo(func(L *lua.LState) {
+		L.SetGlobal(name, value)
+	})
 }
 
-// SetGlobalFunction makes a Go function available from Lua.
+// SetGlobalFunction makes a Go function available from the Lua console.
 // The Go function must take a Lua state as an argument and
 // return the number of return values it pushed onto the Lua stack.
-// While the Go function is called, the luaLock mutex will be held.
 func SetGlobalFunction(name string, goFunction lua.LGFunction) {
-	luaLock.Lock()
-	defer luaLock.Unlock()
-	luaState.SetGlobal(name, luaState.NewFunction(goFunction))
+	WithLuaStateDo(func(L *lua.LState) {
+		L.SetGlobal(name, L.NewFunction(goFunction))
+	})
 }
 
-// WithLuaStateDo locks the luaLock mutex,
-// calls the given Go function with the lua.LState as an argument,
-// then releases the luaLock mutex.
+// WithLuaStateDo calls the given Go function with the lua.LState
+// of the Lua console as an argument while holding its lock.
 func WithLuaStateDo(action func(*lua.LState)) {
-	luaLock.Lock()
-	defer luaLock.Unlock()
-	action(luaState)
+	s := console()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isClosed() {
+		return
+	}
+	action(s.L)
 }
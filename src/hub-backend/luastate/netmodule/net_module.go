@@ -0,0 +1,574 @@
+// Package netmodule provides the "net" Lua module, which lets hub scripts
+// exchange data over UDP, TCP and HTTP.
+//
+// All I/O is performed by Go goroutines. Received data is passed to Lua
+// callbacks through a Deliverer, which calls them under the lock of the
+// Lua state. The module is sandboxed: by default, it can only connect to
+// addresses on the local computer or a private network, the number of open
+// sockets and requests is limited, and everything is closed together with
+// the Lua state.
+package netmodule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// AllowPublicAddresses allows scripts to connect to addresses on the internet.
+// This will be set from dcs-bios-hub.go.
+var AllowPublicAddresses = false
+
+const (
+	maxOpenSockets       = 16
+	maxPendingRequests   = 8
+	maxDatagramSize      = 65507
+	tcpReadBufferSize    = 64 * 1024
+	tcpSendQueueSize     = 64
+	tcpConnectTimeout    = 5 * time.Second
+	defaultHttpTimeout   = 10 * time.Second
+	maxHttpTimeout       = 60 * time.Second
+	maxHttpResponseBytes = 1024 * 1024
+)
+
+const (
+	udpSocketTypeName = "net.udp"
+	tcpConnTypeName   = "net.tcp"
+)
+
+var errModuleClosed = errors.New("the script has been stopped")
+
+// A Deliverer calls a Lua function from a Go goroutine. It must acquire the
+// lock of the Lua state, call call with the Lua state unless the state has
+// been closed, and handle the returned error.
+type Deliverer func(call func(L *lua.LState) error)
+
+// Module holds the sockets and requests that have been opened by one Lua state.
+type Module struct {
+	deliver   Deliverer
+	transport *http.Transport // shared by all HTTP requests of this module
+
+	lock   sync.Mutex // protects the fields below
+	closed bool
+	// the value is true for UDP sockets that are bound to a fixed port
+	sockets         map[io.Closer]bool
+	pendingRequests int
+	ctx             context.Context
+	cancel          context.CancelFunc
+}
+
+// Preload makes the "net" module available to require() in the given Lua state.
+// The returned Module must be closed when the Lua state is closed.
+func Preload(L *lua.LState, deliver Deliverer) *Module {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Module{
+		deliver: deliver,
+		transport: &http.Transport{
+			DialContext: newDialer(tcpConnectTimeout).DialContext,
+		},
+		sockets: make(map[io.Closer]bool),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	L.PreloadModule("net", m.Loader)
+	return m
+}
+
+// Loader is called by gopher-lua to provide the "net" module
+// to the Lua environment.
+func (m *Module) Loader(L *lua.LState) int {
+	udpMeta := L.NewTypeMetatable(udpSocketTypeName)
+	L.SetField(udpMeta, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"send":      m.udpSend,
+		"onReceive": m.udpOnReceive,
+		"close":     m.udpClose,
+	}))
+	tcpMeta := L.NewTypeMetatable(tcpConnTypeName)
+	L.SetField(tcpMeta, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"send":  m.tcpSend,
+		"close": m.tcpClose,
+	}))
+
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"udp":         m.udpOpen,
+		"tcpConnect":  m.tcpConnect,
+		"httpRequest": m.httpRequest,
+	})
+	L.Push(mod)
+	return 1
+}
+
+// Close closes all sockets and cancels all requests of this module.
+// Callbacks that have not been delivered yet are dropped.
+func (m *Module) Close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.closed = true
+	m.cancel()
+	for socket := range m.sockets {
+		socket.Close()
+	}
+	m.sockets = make(map[io.Closer]bool)
+	m.transport.CloseIdleConnections()
+}
+
+// HasBoundPorts returns true if a UDP socket of this module is bound to
+// a fixed port, which another Lua state cannot open at the same time.
+func (m *Module) HasBoundPorts() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, boundPort := range m.sockets {
+		if boundPort {
+			return true
+		}
+	}
+	return false
+}
+
+// addSocket registers a socket so it is closed with the module.
+// boundPort is true for a UDP socket that is bound to a fixed port.
+func (m *Module) addSocket(socket io.Closer, boundPort bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return errModuleClosed
+	}
+	if len(m.sockets) >= maxOpenSockets {
+		return fmt.Errorf("too many open sockets (the limit is %d)", maxOpenSockets)
+	}
+	m.sockets[socket] = boundPort
+	return nil
+}
+
+func (m *Module) removeSocket(socket io.Closer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.sockets, socket)
+}
+
+// isAllowedIP returns true if scripts may exchange data with ip.
+func isAllowedIP(ip net.IP) bool {
+	if AllowPublicAddresses || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	privateNetworks := []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
+	for _, cidr := range privateNetworks {
+		_, network, _ := net.ParseCIDR(cidr)
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDialAddress is used as net.Dialer.Control to reject
+// connections to addresses that are not allowed.
+func checkDialAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isAllowedIP(ip) {
+		return fmt.Errorf("connections to %s are not allowed", host)
+	}
+	return nil
+}
+
+func newDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: checkDialAddress,
+	}
+}
+
+// pushError pushes nil and an error message, the usual Lua convention for failures.
+func pushError(L *lua.LState, err error) int {
+	L.Push(lua.LNil)
+	L.Push(lua.LString(err.Error()))
+	return 2
+}
+
+// callFunction calls fn with args if fn is not nil.
+func callFunction(L *lua.LState, fn *lua.LFunction, args ...lua.LValue) error {
+	if fn == nil {
+		return nil
+	}
+	return L.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    0,
+		Protect: true,
+	}, args...)
+}
+
+// udpSocket is the Go value of a UDP socket userdata.
+// onReceive is only accessed while holding the lock of the Lua state.
+type udpSocket struct {
+	conn      *net.UDPConn
+	onReceive *lua.LFunction
+}
+
+// udp([port, [bindAddress]])
+// opens a UDP socket on the given local port (default: any free port).
+// bindAddress defaults to "127.0.0.1"; use "0.0.0.0" to receive
+// datagrams from other computers.
+// Returns the socket, or nil and an error message.
+func (m *Module) udpOpen(L *lua.LState) int {
+	port := L.OptInt(1, 0)
+	bindAddress := L.OptString(2, "127.0.0.1")
+	ip := net.ParseIP(bindAddress)
+	if ip == nil {
+		L.ArgError(2, "not an IP address")
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+	if err != nil {
+		return pushError(L, err)
+	}
+	if err := m.addSocket(conn, port != 0); err != nil {
+		conn.Close()
+		return pushError(L, err)
+	}
+
+	sock := &udpSocket{conn: conn}
+	ud := L.NewUserData()
+	ud.Value = sock
+	L.SetMetatable(ud, L.GetTypeMetatable(udpSocketTypeName))
+	go m.receiveUDP(sock)
+
+	L.Push(ud)
+	return 1
+}
+
+func (m *Module) receiveUDP(sock *udpSocket) {
+	defer m.removeSocket(sock.conn)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := sock.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		data := string(buf[:n])
+		m.deliver(func(L *lua.LState) error {
+			return callFunction(L, sock.onReceive, lua.LString(data), lua.LString(addr.IP.String()), lua.LNumber(addr.Port))
+		})
+	}
+}
+
+func checkUDPSocket(L *lua.LState) *udpSocket {
+	ud := L.CheckUserData(1)
+	sock, ok := ud.Value.(*udpSocket)
+	if !ok {
+		L.ArgError(1, "UDP socket expected")
+	}
+	return sock
+}
+
+// socket:send(host, port, data)
+// sends a datagram. Returns true, or nil and an error message.
+func (m *Module) udpSend(L *lua.LState) int {
+	sock := checkUDPSocket(L)
+	host := L.CheckString(2)
+	port := L.CheckInt(3)
+	data := L.CheckString(4)
+	if len(data) > maxDatagramSize {
+		L.ArgError(4, "datagram too large")
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, fmt.Sprint(port)))
+	if err != nil {
+		return pushError(L, err)
+	}
+	if !isAllowedIP(addr.IP) {
+		return pushError(L, fmt.Errorf("sending to %s is not allowed", addr.IP))
+	}
+	if _, err := sock.conn.WriteToUDP([]byte(data), addr); err != nil {
+		return pushError(L, err)
+	}
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// socket:onReceive(fn)
+// sets the function that is called with (data, host, port)
+// for every datagram that is received.
+func (m *Module) udpOnReceive(L *lua.LState) int {
+	sock := checkUDPSocket(L)
+	sock.onReceive = L.OptFunction(2, nil)
+	return 0
+}
+
+// socket:close()
+func (m *Module) udpClose(L *lua.LState) int {
+	sock := checkUDPSocket(L)
+	sock.conn.Close()
+	m.removeSocket(sock.conn)
+	return 0
+}
+
+// tcpConnection is the Go value of a TCP connection userdata.
+// The callbacks are only accessed while holding the lock of the Lua state.
+type tcpConnection struct {
+	onConnect *lua.LFunction
+	onData    *lua.LFunction
+	onClose   *lua.LFunction
+
+	sendQueue chan []byte
+	closeOnce sync.Once
+	closed    chan struct{}
+	conn      net.Conn // set once the connection has been established
+	connLock  sync.Mutex
+}
+
+func (c *tcpConnection) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.connLock.Lock()
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		c.connLock.Unlock()
+	})
+	return nil
+}
+
+// tcpConnect(host, port, callbacks)
+// opens a TCP connection in the background. callbacks is a table with
+// the optional functions onConnect(), onData(data) and onClose(err).
+// Returns the connection, or nil and an error message.
+func (m *Module) tcpConnect(L *lua.LState) int {
+	host := L.CheckString(1)
+	port := L.CheckInt(2)
+	callbacks := L.OptTable(3, L.NewTable())
+
+	c := &tcpConnection{
+		sendQueue: make(chan []byte, tcpSendQueueSize),
+		closed:    make(chan struct{}),
+	}
+	c.onConnect, _ = callbacks.RawGetString("onConnect").(*lua.LFunction)
+	c.onData, _ = callbacks.RawGetString("onData").(*lua.LFunction)
+	c.onClose, _ = callbacks.RawGetString("onClose").(*lua.LFunction)
+	if err := m.addSocket(c, false); err != nil {
+		return pushError(L, err)
+	}
+
+	go m.runTCPConnection(c, net.JoinHostPort(host, fmt.Sprint(port)))
+
+	ud := L.NewUserData()
+	ud.Value = c
+	L.SetMetatable(ud, L.GetTypeMetatable(tcpConnTypeName))
+	L.Push(ud)
+	return 1
+}
+
+func (m *Module) runTCPConnection(c *tcpConnection, address string) {
+	defer m.removeSocket(c)
+	defer c.Close()
+
+	conn, err := newDialer(tcpConnectTimeout).DialContext(m.ctx, "tcp", address)
+	if err != nil {
+		m.deliverTCPClose(c, err)
+		return
+	}
+	c.connLock.Lock()
+	c.conn = conn
+	c.connLock.Unlock()
+	select {
+	case <-c.closed:
+		// closed while connecting
+		conn.Close()
+		return
+	default:
+	}
+
+	m.deliver(func(L *lua.LState) error {
+		return callFunction(L, c.onConnect)
+	})
+
+	go func() {
+		for {
+			select {
+			case data := <-c.sendQueue:
+				if _, err := conn.Write(data); err != nil {
+					c.Close()
+					return
+				}
+			case <-c.closed:
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, tcpReadBufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			data := string(buf[:n])
+			m.deliver(func(L *lua.LState) error {
+				return callFunction(L, c.onData, lua.LString(data))
+			})
+		}
+		if err != nil {
+			select {
+			case <-c.closed:
+				// closed by the script
+				m.deliverTCPClose(c, nil)
+			default:
+				if err == io.EOF {
+					err = nil
+				}
+				m.deliverTCPClose(c, err)
+			}
+			return
+		}
+	}
+}
+
+func (m *Module) deliverTCPClose(c *tcpConnection, err error) {
+	m.deliver(func(L *lua.LState) error {
+		var errValue lua.LValue = lua.LNil
+		if err != nil {
+			errValue = lua.LString(err.Error())
+		}
+		return callFunction(L, c.onClose, errValue)
+	})
+}
+
+func checkTCPConnection(L *lua.LState) *tcpConnection {
+	ud := L.CheckUserData(1)
+	c, ok := ud.Value.(*tcpConnection)
+	if !ok {
+		L.ArgError(1, "TCP connection expected")
+	}
+	return c
+}
+
+// conn:send(data)
+// queues data to be sent once the connection is established.
+// Returns false if the connection is closed or the send queue is full.
+func (m *Module) tcpSend(L *lua.LState) int {
+	c := checkTCPConnection(L)
+	data := L.CheckString(2)
+	select {
+	case <-c.closed:
+		L.Push(lua.LFalse)
+		return 1
+	default:
+	}
+	select {
+	case c.sendQueue <- []byte(data):
+		L.Push(lua.LTrue)
+	default:
+		L.Push(lua.LFalse)
+	}
+	return 1
+}
+
+// conn:close()
+func (m *Module) tcpClose(L *lua.LState) int {
+	checkTCPConnection(L).Close()
+	return 0
+}
+
+// httpRequest(options, fn)
+// performs an HTTP request in the background. options is a table with the
+// fields url, method (default "GET"), headers (a table), body and timeout
+// (in milliseconds, default 10000, at most 60000).
+// fn is called with a response table {status, headers, body}, or with nil
+// and an error message. Response bodies are limited to 1 MB.
+// Returns true, or nil and an error message if the request could not be started.
+func (m *Module) httpRequest(L *lua.LState) int {
+	opts := L.CheckTable(1)
+	fn := L.CheckFunction(2)
+
+	url := lua.LVAsString(opts.RawGetString("url"))
+	method := strings.ToUpper(lua.LVAsString(opts.RawGetString("method")))
+	if method == "" {
+		method = "GET"
+	}
+	timeout := defaultHttpTimeout
+	if ms, ok := opts.RawGetString("timeout").(lua.LNumber); ok {
+		timeout = time.Duration(float64(ms) * float64(time.Millisecond))
+	}
+	if timeout <= 0 || timeout > maxHttpTimeout {
+		timeout = maxHttpTimeout
+	}
+
+	req, err := http.NewRequest(method, url, strings.NewReader(lua.LVAsString(opts.RawGetString("body"))))
+	if err != nil {
+		return pushError(L, err)
+	}
+	if headers, ok := opts.RawGetString("headers").(*lua.LTable); ok {
+		headers.ForEach(func(key, value lua.LValue) {
+			req.Header.Set(key.String(), value.String())
+		})
+	}
+
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return pushError(L, errModuleClosed)
+	}
+	if m.pendingRequests >= maxPendingRequests {
+		m.lock.Unlock()
+		return pushError(L, fmt.Errorf("too many pending HTTP requests (the limit is %d)", maxPendingRequests))
+	}
+	m.pendingRequests++
+	ctx := m.ctx
+	m.lock.Unlock()
+
+	go func() {
+		defer func() {
+			m.lock.Lock()
+			m.pendingRequests--
+			m.lock.Unlock()
+		}()
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		status, header, body, err := m.doHttpRequest(req.WithContext(ctx))
+		m.deliver(func(L *lua.LState) error {
+			if err != nil {
+				return callFunction(L, fn, lua.LNil, lua.LString(err.Error()))
+			}
+			headers := L.NewTable()
+			for key := range header {
+				headers.RawSetString(key, lua.LString(header.Get(key)))
+			}
+			response := L.NewTable()
+			response.RawSetString("status", lua.LNumber(status))
+			response.RawSetString("headers", headers)
+			response.RawSetString("body", lua.LString(body))
+			return callFunction(L, fn, response)
+		})
+	}()
+
+	L.Push(lua.LTrue)
+	return 1
+}
+
+func (m *Module) doHttpRequest(req *http.Request) (status int, header http.Header, body []byte, err error) {
+	client := &http.Client{Transport: m.transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(io.LimitReader(resp.Body, maxHttpResponseBytes+1))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if len(body) > maxHttpResponseBytes {
+		return 0, nil, nil, fmt.Errorf("the response is larger than %d bytes", maxHttpResponseBytes)
+	}
+	return resp.StatusCode, resp.Header, body, nil
+}
@@ -0,0 +1,140 @@
+package luastate
+
+import (
+	"io/ioutil"
+	"sort"
+)
+
+// PluginScript is a hub script that is provided by a plugin.
+// Enabled and Aircraft are used when the script is added to the script list
+// for the first time; afterwards, the user can change them.
+type PluginScript struct {
+	Path     string
+	Enabled  bool
+	Aircraft []string
+}
+
+// pluginScripts maps the name of each loaded plugin to the scripts it provides.
+// It is protected by luaLock.
+var pluginScripts = make(map[string][]PluginScript)
+
+// scriptListLoaded is set by the first call to Reset. Until then,
+// SetPluginScripts only remembers the scripts, so scriptlist.json
+// is not overwritten before it has been read.
+var scriptListLoaded = false
+
+// SetPluginScripts sets the hub scripts provided by a plugin.
+// It is called by the plugin manager when a plugin is loaded (with the
+// scripts from its manifest) or unloaded (with nil, e.g. while the plugin
+// is being updated). The scripts of the plugin are restarted, as they may
+// have been changed by an update. The scripts of an unloaded plugin stay
+// in the script list, so they keep their position and Enabled flag.
+func SetPluginScripts(plugin string, scripts []PluginScript) {
+	luaLock.Lock()
+	if len(scripts) == 0 {
+		delete(pluginScripts, plugin)
+	} else {
+		pluginScripts[plugin] = scripts
+	}
+	if !scriptListLoaded {
+		luaLock.Unlock()
+		return
+	}
+
+	for _, entry := range scriptList {
+		if entry.Plugin == plugin {
+			stopScript(entry.Path)
+		}
+	}
+	mergePluginScripts(false)
+	// scripts of the plugin that are being loaded may be outdated
+	scriptListVersion++
+	storeScriptList()
+	notifyScriptListSubscribers()
+	luaLock.Unlock()
+
+	startScripts(ioutil.Discard)
+}
+
+// RemovePluginScripts stops the scripts of a plugin that has been
+// uninstalled and removes them from the script list.
+func RemovePluginScripts(plugin string) {
+	luaLock.Lock()
+	defer luaLock.Unlock()
+
+	delete(pluginScripts, plugin)
+	list := make([]ScriptListEntry, 0, len(scriptList))
+	for _, entry := range scriptList {
+		if entry.Plugin == plugin {
+			stopScript(entry.Path)
+			continue
+		}
+		list = append(list, entry)
+	}
+	scriptList = list
+	if scriptListLoaded {
+		storeScriptList()
+		notifyScriptListSubscribers()
+	}
+}
+
+// pluginOwningScript returns the name of the loaded plugin that provides
+// the script at path, or the empty string. The caller must hold luaLock.
+func pluginOwningScript(path string) string {
+	for plugin, scripts := range pluginScripts {
+		for _, ps := range scripts {
+			if ps.Path == path {
+				return plugin
+			}
+		}
+	}
+	return ""
+}
+
+// isPluginLoaded returns true if the plugin has scripts in pluginScripts.
+// The caller must hold luaLock.
+func isPluginLoaded(plugin string) bool {
+	_, ok := pluginScripts[plugin]
+	return ok
+}
+
+// mergePluginScripts updates the script list to match pluginScripts.
+// Scripts that are not in the list yet are appended; existing entries keep
+// their position and their Enabled flag. If removeUnloaded is true, the
+// scripts of plugins that are not loaded are removed from the list.
+// The caller must hold luaLock.
+func mergePluginScripts(removeUnloaded bool) {
+	list := make([]ScriptListEntry, 0, len(scriptList))
+	present := make(map[string]bool)
+	for _, entry := range scriptList {
+		if owner := pluginOwningScript(entry.Path); owner != "" {
+			entry.Plugin = owner
+		} else if entry.Plugin != "" && removeUnloaded {
+			stopScript(entry.Path)
+			continue
+		}
+		list = append(list, entry)
+		present[entry.Path] = true
+	}
+
+	plugins := make([]string, 0, len(pluginScripts))
+	for plugin := range pluginScripts {
+		plugins = append(plugins, plugin)
+	}
+	sort.Strings(plugins)
+	for _, plugin := range plugins {
+		for _, ps := range pluginScripts[plugin] {
+			if present[ps.Path] {
+				continue
+			}
+			list = append(list, ScriptListEntry{
+				Path:     ps.Path,
+				Enabled:  ps.Enabled,
+				Plugin:   plugin,
+				Aircraft: ps.Aircraft,
+			})
+			present[ps.Path] = true
+		}
+	}
+	scriptList = list
+}
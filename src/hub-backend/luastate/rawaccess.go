@@ -0,0 +1,117 @@
+package luastate
+
+import (
+	lua "github.com/yuin/gopher-lua"
+)
+
+// maxDataAddress is the highest address that scripts can write to.
+// 0xFFFE is the update counter that marks the end of an update.
+const maxDataAddress = 0xFFFC
+
+// checkAddress returns the address argument n,
+// raising a Lua error if it is not an even number in the export data range.
+func checkAddress(L *lua.LState, n int) uint16 {
+	addr := L.CheckInt(n)
+	if addr < 0 || addr > maxDataAddress || addr%2 != 0 {
+		L.ArgError(n, "address must be an even number between 0 and 0xFFFC")
+	}
+	return uint16(addr)
+}
+
+// checkLength returns the length argument n, raising a Lua error if
+// length bytes starting at addr do not fit into the export data range.
+func checkLength(L *lua.LState, n int, addr uint16, length int) uint16 {
+	if length < 0 || int(addr)+length > maxDataAddress+2 {
+		L.ArgError(n, "data does not fit below address 0xFFFE")
+	}
+	return uint16(length)
+}
+
+// checkWord returns the argument n, raising a Lua error
+// if it is not an integer between 0 and 0xFFFF.
+func checkWord(L *lua.LState, n int) uint16 {
+	value := L.CheckInt(n)
+	if value < 0 || value > 0xFFFF {
+		L.ArgError(n, "value must be between 0 and 0xFFFF")
+	}
+	return uint16(value)
+}
+
+// checkBitField returns the mask and shift arguments starting at n,
+// raising a Lua error if the shift is out of range.
+func checkBitField(L *lua.LState, n int) (mask uint16, shift uint16) {
+	mask = checkWord(L, n)
+	s := L.CheckInt(n + 1)
+	if s < 0 || s > 15 {
+		L.ArgError(n+1, "shift must be between 0 and 15")
+	}
+	return mask, uint16(s)
+}
+
+// getSimWord(address)
+// returns the 16-bit word at the given address in the sim data.
+func getSimWord(L *lua.LState) int {
+	addr := checkAddress(L, 1)
+	L.Push(lua.LNumber(currentSimData().GetValueAtAddress(addr)))
+	return 1
+}
+
+// getPanelWord(address)
+// returns the 16-bit word at the given address in the panel data.
+func getPanelWord(L *lua.LState) int {
+	addr := checkAddress(L, 1)
+	L.Push(lua.LNumber(ExportDataBuffer.GetValueAtAddress(addr)))
+	return 1
+}
+
+// setPanelWord(address, value)
+// sets the 16-bit word at the given address in the panel data.
+func setPanelWord(L *lua.LState) int {
+	addr := checkAddress(L, 1)
+	value := checkWord(L, 2)
+	ExportDataBuffer.SetUint16(addr, value)
+	return 0
+}
+
+// getSimBytes(address, length)
+// returns length bytes starting at the given address in the sim data as a string.
+func getSimBytes(L *lua.LState) int {
+	addr := checkAddress(L, 1)
+	length := checkLength(L, 2, addr, L.CheckInt(2))
+	L.Push(lua.LString(currentSimData().GetBytes(addr, length)))
+	return 1
+}
+
+// setPanelBytes(address, str)
+// writes the bytes of str to the panel data starting at the given address.
+func setPanelBytes(L *lua.LState) int {
+	addr := checkAddress(L, 1)
+	data := L.CheckString(2)
+	checkLength(L, 2, addr, len(data))
+	ExportDataBuffer.SetBytes(addr, []byte(data))
+	return 0
+}
+
+// getSimBits(address, mask, shift)
+// returns (word & mask) >> shift for the word at the given address in the sim data.
+func getSimBits(L *lua.LState) int {
+	addr := checkAddress(L, 1)
+	mask, shift := checkBitField(L, 2)
+	L.Push(lua.LNumber((currentSimData().GetValueAtAddress(addr) & mask) >> shift))
+	return 1
+}
+
+// setPanelBits(address, mask, shift, value)
+// replaces the bits selected by mask in the word at the given address
+// in the panel data with value << shift.
+// Raises an error if value does not fit into the bit field.
+func setPanelBits(L *lua.LState) int {
+	addr := checkAddress(L, 1)
+	mask, shift := checkBitField(L, 2)
+	value := checkWord(L, 4)
+	if (value<<shift)&^mask != 0 || (value<<shift)>>shift != value {
+		L.ArgError(4, "value does not fit into the bit field")
+	}
+	ExportDataBuffer.SetBits(addr, mask, value<<shift)
+	return 0
+}
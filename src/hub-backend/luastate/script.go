@@ -0,0 +1,380 @@
+package luastate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"dcs-bios.a10c.de/dcs-bios-hub/exportdataparser"
+	"dcs-bios.a10c.de/dcs-bios-hub/luastate/netmodule"
+	"dcs-bios.a10c.de/dcs-bios-hub/luastate/shmmodule"
+	"github.com/nubix-io/gluabit32"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// DefaultCallbackTimeLimit is the maximum time a single call to an input
+// or output callback may take before it is aborted.
+const DefaultCallbackTimeLimit = 100 * time.Millisecond
+
+// scriptTimeLimit is the maximum time the main chunk of a script
+// or a snippet from the Lua console may take before it is aborted.
+const scriptTimeLimit = 5 * time.Second
+
+var callbackTimeLimit = DefaultCallbackTimeLimit
+var callbackTimeLimitLock sync.Mutex
+
+// SetCallbackTimeLimit sets the maximum time a single call to an input or
+// output callback may take. A callback that exceeds the limit is aborted and
+// will not be called again until the script is reloaded.
+// A limit of zero disables the limit.
+func SetCallbackTimeLimit(limit time.Duration) {
+	callbackTimeLimitLock.Lock()
+	defer callbackTimeLimitLock.Unlock()
+	callbackTimeLimit = limit
+}
+
+func getCallbackTimeLimit() time.Duration {
+	callbackTimeLimitLock.Lock()
+	defer callbackTimeLimitLock.Unlock()
+	return callbackTimeLimit
+}
+
+// timeLimitError is returned when Lua code has been aborted
+// because it exceeded its time limit.
+type timeLimitError struct {
+	limit time.Duration
+}
+
+func (e timeLimitError) Error() string {
+	return fmt.Sprintf("aborted after exceeding the time limit of %v", e.limit)
+}
+
+// script is a user script (or the Lua console) that runs in its own Lua state,
+// so a script cannot interfere with the globals of another script and
+// can be reloaded without affecting the others.
+type script struct {
+	path            string
+	lock            sync.Mutex // must be held while accessing the fields below
+	L               *lua.LState
+	done            chan struct{} // closed when the script is closed
+	shm             *shmmodule.Module
+	net             *netmodule.Module
+	inputCallbacks  []*lua.LFunction
+	outputCallbacks []*lua.LFunction
+	valueCallbacks  []*valueChangeCallback
+	// functions passed to hub.defineInput, by command name
+	virtualInputs map[string]*lua.LFunction
+	// files maps the script file and every file it loaded with dofile
+	// or loadfile to its modification time at the time it was loaded.
+	files map[string]time.Time
+	// timers created by hub.setTimeout and hub.setInterval, by id
+	timers      map[int]*luaTimer
+	nextTimerID int
+	// Lua console sessions, by session id
+	sessions map[string]*consoleSession
+}
+
+// newScript creates a new Lua state with the "hub", "shm" and "bit32" modules.
+// If path is not empty, _SCRIPTDIR is set to the directory that contains it.
+func newScript(path string) *script {
+	s := &script{
+		path:   path,
+		L:      lua.NewState(),
+		done:   make(chan struct{}),
+		files:  make(map[string]time.Time),
+		timers: make(map[int]*luaTimer),
+
+		virtualInputs: make(map[string]*lua.LFunction),
+	}
+	s.L.SetGlobal("print", s.L.NewFunction(s.print))
+	s.L.PreloadModule("hub", s.hubModuleLoader)
+	s.shm = shmmodule.Preload(s.L)
+	s.net = netmodule.Preload(s.L, s.deliver)
+	gluabit32.Preload(s.L)
+	if err := s.L.DoString(`hub = require("hub")`); err != nil {
+		panic(err)
+	}
+	if path != "" {
+		s.L.SetGlobal("_SCRIPTDIR", lua.LString(filepath.Dir(path)+string(os.PathSeparator)))
+		s.L.SetGlobal("dofile", s.L.NewFunction(s.watchFileLoader(s.L.GetGlobal("dofile"))))
+		s.L.SetGlobal("loadfile", s.L.NewFunction(s.watchFileLoader(s.L.GetGlobal("loadfile"))))
+	}
+	s.L.Options.IncludeGoStackTrace = true
+	return s
+}
+
+// loadScript creates a new Lua state for the script at path and executes it.
+// Progress and errors are written to logBuffer. If the script cannot be
+// executed, the returned error is non-nil, but the script is still returned
+// so it can be closed.
+func loadScript(path string, logBuffer io.Writer) (*script, error) {
+	stat, err := os.Stat(path)
+	if err != nil || stat.IsDir() {
+		fmt.Fprintf(logBuffer, "file not found: %s\n", path)
+		logScriptMessage(path, ScriptLogLevelError, "file not found")
+		return nil, fmt.Errorf("file not found: %s", path)
+	}
+
+	fmt.Fprintf(logBuffer, "loading: %s\n", path)
+	logScriptMessage(path, ScriptLogLevelInfo, "loading")
+	s := newScript(path)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.files[path] = stat.ModTime()
+	err = s.withTimeLimit(scriptTimeLimit, func() error {
+		return s.L.DoFile(path)
+	})
+	if err != nil {
+		fmt.Fprintf(logBuffer, "lua error: %v\n", err)
+		logScriptError(path, "", err)
+		return s, err
+	}
+	return s, nil
+}
+
+// print replaces the print function of the Lua standard library
+// and writes to the script log instead of the standard output.
+func (s *script) print(L *lua.LState) int {
+	top := L.GetTop()
+	parts := make([]string, top)
+	for i := 1; i <= top; i++ {
+		parts[i-1] = L.ToStringMeta(L.Get(i)).String()
+	}
+	logScriptMessage(s.path, ScriptLogLevelPrint, strings.Join(parts, "\t"))
+	return 0
+}
+
+// watchFileLoader wraps the dofile or loadfile function of the Lua standard
+// library so the file that is loaded is added to s.files.
+func (s *script) watchFileLoader(loader lua.LValue) lua.LGFunction {
+	return func(L *lua.LState) int {
+		if path, ok := L.Get(1).(lua.LString); ok {
+			var modTime time.Time
+			if stat, err := os.Stat(string(path)); err == nil {
+				modTime = stat.ModTime()
+			}
+			s.files[string(path)] = modTime
+		}
+		top := L.GetTop()
+		L.Push(loader)
+		for i := 1; i <= top; i++ {
+			L.Push(L.Get(i))
+		}
+		L.Call(top, lua.MultRet)
+		return L.GetTop() - top
+	}
+}
+
+// watchedFiles returns a copy of s.files.
+func (s *script) watchedFiles() map[string]time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	files := make(map[string]time.Time, len(s.files))
+	for path, modTime := range s.files {
+		files[path] = modTime
+	}
+	return files
+}
+
+// setWatchedFiles replaces the modification times in s.files, so changes
+// that have already been handled do not trigger another reload.
+func (s *script) setWatchedFiles(files map[string]time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for path, modTime := range files {
+		s.files[path] = modTime
+	}
+}
+
+// holdsExclusiveResources returns true if the script has bound a UDP port
+// or created a shared memory area, so a new version of the script
+// cannot acquire them while this one is running.
+func (s *script) holdsExclusiveResources() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isClosed() {
+		return false
+	}
+	return s.net.HasBoundPorts() || s.shm.HasCreatedAreas()
+}
+
+// close releases the Lua state of the script. Callbacks of a closed
+// script are no longer called.
+func (s *script) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.L == nil {
+		return
+	}
+	s.inputCallbacks = nil
+	s.outputCallbacks = nil
+	s.valueCallbacks = nil
+	s.virtualInputs = nil
+	s.stopTimers()
+	s.removeVirtualControls()
+	close(s.done)
+	s.shm.Close()
+	s.net.Close()
+	s.L.Close()
+	s.L = nil
+}
+
+// isClosed returns true if close() has been called. The caller must hold s.lock.
+func (s *script) isClosed() bool {
+	return s.L == nil
+}
+
+// withTimeLimit calls action, which executes code in s.L, and aborts the
+// Lua code if it runs longer than limit. A limit of zero disables the limit.
+// The caller must hold s.lock.
+func (s *script) withTimeLimit(limit time.Duration, action func() error) error {
+	if limit <= 0 {
+		return action()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), limit)
+	defer cancel()
+	s.L.SetContext(ctx)
+	defer s.L.RemoveContext()
+
+	err := action()
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return timeLimitError{limit: limit}
+	}
+	return err
+}
+
+// notifyInputCallbacks calls the input callbacks of this script in reverse
+// order of registration. Returns true if a callback handled the command.
+// Callbacks that exceed the time limit are removed and described in incidents.
+func (s *script) notifyInputCallbacks(cmd string, arg string, source string) (handledByLua bool, incidents []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isClosed() {
+		return false, nil
+	}
+	limit := getCallbackTimeLimit()
+	if fn, ok := s.virtualInputs[cmd]; ok {
+		err := s.withTimeLimit(limit, func() error {
+			return s.L.CallByParam(lua.P{
+				Fn:      fn,
+				NRet:    0,
+				Protect: true,
+			}, lua.LString(arg))
+		})
+		if _, ok := err.(timeLimitError); ok {
+			delete(s.virtualInputs, cmd)
+			incidents = append(incidents, fmt.Sprintf("input function for %s disabled: %v", cmd, err))
+		} else if err != nil {
+			logScriptError(s.path, "input function for "+cmd+": ", err)
+		}
+		return true, incidents
+	}
+	for _, cb := range s.inputCallbacks {
+		var returnValue lua.LValue = lua.LNil
+		err := s.withTimeLimit(limit, func() error {
+			err := s.L.CallByParam(lua.P{
+				Fn:      cb,
+				NRet:    1,
+				Protect: true,
+			}, lua.LString(cmd), lua.LString(arg), lua.LString(source))
+			if err == nil {
+				returnValue = s.L.Get(-1)
+				s.L.Pop(1)
+			}
+			return err
+		})
+		if _, ok := err.(timeLimitError); ok {
+			s.inputCallbacks = removeCallback(s.inputCallbacks, cb)
+			incidents = append(incidents, fmt.Sprintf("input callback %s disabled while handling %s %s: %v", callbackLocation(cb), cmd, arg, err))
+			continue
+		}
+		if err != nil {
+			logScriptError(s.path, "input callback: ", err)
+		}
+		if lua.LVAsBool(returnValue) {
+			return true, incidents
+		}
+	}
+	return false, incidents
+}
+
+// notifyOutputCallbacks calls the value change callbacks for all values
+// that have changed in simData, then the output callbacks of this script
+// in the order they were registered.
+// Callbacks that exceed the time limit are removed and described in incidents.
+func (s *script) notifyOutputCallbacks(simData *exportdataparser.DataBuffer) (incidents []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isClosed() {
+		return nil
+	}
+	limit := getCallbackTimeLimit()
+	incidents = s.notifyValueChangeCallbacks(simData, limit)
+	for _, cb := range s.outputCallbacks {
+		err := s.withTimeLimit(limit, func() error {
+			return s.L.CallByParam(lua.P{
+				Fn:      cb,
+				NRet:    0,
+				Protect: true,
+			})
+		})
+		if _, ok := err.(timeLimitError); ok {
+			s.outputCallbacks = removeCallback(s.outputCallbacks, cb)
+			incidents = append(incidents, fmt.Sprintf("output callback %s disabled: %v", callbackLocation(cb), err))
+		} else if err != nil {
+			logScriptError(s.path, "output callback: ", err)
+		}
+	}
+	return incidents
+}
+
+// deliver calls a Lua function on behalf of a Go goroutine of the net module.
+// The function is called under the lock of the script with the callback time
+// limit; it is dropped if the script has been closed.
+func (s *script) deliver(call func(L *lua.LState) error) {
+	var incidents []string
+	defer func() { reportIncidents(s, incidents) }()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isClosed() {
+		return
+	}
+	err := s.withTimeLimit(getCallbackTimeLimit(), func() error {
+		return call(s.L)
+	})
+	if _, ok := err.(timeLimitError); ok {
+		incidents = append(incidents, fmt.Sprintf("net callback aborted: %v", err))
+	} else if err != nil {
+		logScriptError(s.path, "net callback: ", err)
+	}
+}
+
+// removeCallback returns a copy of callbacks without fn.
+func removeCallback(callbacks []*lua.LFunction, fn *lua.LFunction) []*lua.LFunction {
+	remaining := make([]*lua.LFunction, 0, len(callbacks))
+	for _, cb := range callbacks {
+		if cb != fn {
+			remaining = append(remaining, cb)
+		}
+	}
+	return remaining
+}
+
+// callbackLocation returns the source location where a Lua function was defined.
+func callbackLocation(fn *lua.LFunction) string {
+	if fn.Proto == nil {
+		return "(Go function)"
+	}
+	return fmt.Sprintf("%s:%d", fn.Proto.SourceName, fn.Proto.LineDefined)
+}
+
+// matchesName returns true if name is a (case insensitive) suffix of the script path.
+func (s *script) matchesName(name string) bool {
+	return name != "" && strings.HasSuffix(strings.ToLower(s.path), strings.ToLower(name))
+}
@@ -0,0 +1,205 @@
+package luastate
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"dcs-bios.a10c.de/dcs-bios-hub/jsonapi"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Values for ScriptLogMessage.Level
+const (
+	ScriptLogLevelInfo  = "info"
+	ScriptLogLevelPrint = "print"
+	ScriptLogLevelError = "error"
+)
+
+// ScriptLogMessage is a single entry in the log of a hub script.
+// Script is the path of the script, or empty for the Lua console.
+// If the same message is logged several times in a row, only one
+// entry is kept and Repeated counts the additional occurrences.
+type ScriptLogMessage struct {
+	Time       time.Time `json:"time"`
+	Script     string    `json:"script"`
+	Level      string    `json:"level"`
+	Message    string    `json:"message"`
+	StackTrace string    `json:"stackTrace,omitempty"`
+	Repeated   int       `json:"repeated,omitempty"`
+}
+
+// scriptLogSize is the number of entries kept in the log of each script.
+const scriptLogSize = 200
+
+// scriptLogQueueSize is the number of log messages that are queued for a
+// subscriber. If a subscriber does not keep up, further messages are dropped.
+const scriptLogQueueSize = 64
+
+// scriptLogRing holds the most recent scriptLogSize entries of a script log.
+type scriptLogRing struct {
+	entries []ScriptLogMessage
+	next    int // index of the next entry to overwrite once entries is full
+}
+
+func (r *scriptLogRing) add(msg ScriptLogMessage) {
+	if len(r.entries) < scriptLogSize {
+		r.entries = append(r.entries, msg)
+		return
+	}
+	r.entries[r.next] = msg
+	r.next = (r.next + 1) % scriptLogSize
+}
+
+func (r *scriptLogRing) last() *ScriptLogMessage {
+	if len(r.entries) == 0 {
+		return nil
+	}
+	if len(r.entries) < scriptLogSize {
+		return &r.entries[len(r.entries)-1]
+	}
+	return &r.entries[(r.next+scriptLogSize-1)%scriptLogSize]
+}
+
+// copyEntries returns the entries from oldest to newest.
+func (r *scriptLogRing) copyEntries() []ScriptLogMessage {
+	entries := make([]ScriptLogMessage, 0, len(r.entries))
+	entries = append(entries, r.entries[r.next:]...)
+	entries = append(entries, r.entries[:r.next]...)
+	return entries
+}
+
+// scriptLogLock protects scriptLogs and scriptLogSubscriptions.
+// It may be acquired while holding luaLock or the lock of a script.
+var scriptLogLock sync.Mutex
+var scriptLogs = make(map[string]*scriptLogRing)
+var scriptLogSubscriptions = make(map[chan ScriptLogMessage]bool)
+
+// logScriptMessage adds a message to the log of the script at scriptPath
+// and sends it to all subscribers of monitor_script_log.
+func logScriptMessage(scriptPath string, level string, message string) {
+	addScriptLogEntry(ScriptLogMessage{
+		Time:    time.Now(),
+		Script:  scriptPath,
+		Level:   level,
+		Message: message,
+	})
+}
+
+// logScriptError adds an error to the log of the script at scriptPath.
+// If err is a Lua error, its stack trace is logged as well.
+func logScriptError(scriptPath string, prefix string, err error) {
+	msg := ScriptLogMessage{
+		Time:    time.Now(),
+		Script:  scriptPath,
+		Level:   ScriptLogLevelError,
+		Message: prefix + err.Error(),
+	}
+	if apiErr, ok := err.(*lua.ApiError); ok {
+		msg.Message = prefix + apiErr.Object.String()
+		msg.StackTrace = apiErr.StackTrace
+	}
+	addScriptLogEntry(msg)
+}
+
+func addScriptLogEntry(msg ScriptLogMessage) {
+	scriptLogLock.Lock()
+	defer scriptLogLock.Unlock()
+
+	ring, ok := scriptLogs[msg.Script]
+	if !ok {
+		ring = &scriptLogRing{}
+		scriptLogs[msg.Script] = ring
+	}
+	if last := ring.last(); last != nil && last.Level == msg.Level && last.Message == msg.Message && last.StackTrace == msg.StackTrace {
+		// do not flood the log (and the subscribers) with a callback
+		// that fails every time new data arrives from DCS
+		last.Repeated++
+		last.Time = msg.Time
+		return
+	}
+	ring.add(msg)
+
+	for subscription := range scriptLogSubscriptions {
+		select {
+		case subscription <- msg:
+		default:
+		}
+	}
+}
+
+type GetScriptLogRequest struct {
+	Script string `json:"script"`
+}
+
+type ScriptLog []ScriptLogMessage
+
+// HandleGetScriptLogRequest returns the log entries of a script,
+// or of all scripts if no script is given, from oldest to newest.
+func HandleGetScriptLogRequest(req *GetScriptLogRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+
+	scriptLogLock.Lock()
+	log := ScriptLog{}
+	for script, ring := range scriptLogs {
+		if req.Script == "" || req.Script == script {
+			log = append(log, ring.copyEntries()...)
+		}
+	}
+	scriptLogLock.Unlock()
+
+	if req.Script == "" {
+		sort.SliceStable(log, func(i, j int) bool {
+			return log[i].Time.Before(log[j].Time)
+		})
+	}
+	responseCh <- log
+}
+
+type MonitorScriptLogRequest struct {
+	Script string `json:"script"`
+}
+
+// HandleMonitorScriptLogRequest streams new entries of the log of a script,
+// or of all scripts if no script is given.
+func HandleMonitorScriptLogRequest(ctx context.Context, req *MonitorScriptLogRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+
+	subscription := make(chan ScriptLogMessage, scriptLogQueueSize)
+	scriptLogLock.Lock()
+	scriptLogSubscriptions[subscription] = true
+	scriptLogLock.Unlock()
+
+	defer func() {
+		scriptLogLock.Lock()
+		delete(scriptLogSubscriptions, subscription)
+		scriptLogLock.Unlock()
+	}()
+
+	for {
+		select {
+		case msg := <-subscription:
+			if req.Script != "" && req.Script != msg.Script {
+				continue
+			}
+			select {
+			case responseCh <- msg:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func registerScriptLogApiCalls(jsonAPI *jsonapi.JsonApi) {
+	jsonAPI.RegisterType("get_script_log", GetScriptLogRequest{})
+	jsonAPI.RegisterApiCall("get_script_log", HandleGetScriptLogRequest)
+	jsonAPI.RegisterType("script_log", ScriptLog(nil))
+
+	jsonAPI.RegisterType("monitor_script_log", MonitorScriptLogRequest{})
+	jsonAPI.RegisterStreamingApiCall("monitor_script_log", HandleMonitorScriptLogRequest)
+	jsonAPI.RegisterType("script_log_message", ScriptLogMessage{})
+}
@@ -0,0 +1,72 @@
+package shmmodule
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// region is a shared memory area or memory-mapped file
+// that has been mapped into the address space of the hub.
+// It is implemented in region_windows.go and region_linux.go.
+type region struct {
+	data    []byte
+	release func() error
+	// created is true if the region was created by shm.create
+	// rather than opened or mapped from a file
+	created bool
+}
+
+func (r *region) Close() error {
+	if r.data == nil {
+		return nil
+	}
+	r.data = nil
+	return r.release()
+}
+
+// checkRange returns an error if the length bytes at offset
+// are not entirely inside the region.
+func (r *region) checkRange(offset int64, length int) error {
+	if offset < 0 || length < 0 || offset+int64(length) > int64(len(r.data)) {
+		return fmt.Errorf("offset %d, length %d is out of range (size is %d bytes)", offset, length, len(r.data))
+	}
+	return nil
+}
+
+// byteOrder returns the binary.ByteOrder for "little" or "big".
+func byteOrder(name string) (binary.ByteOrder, error) {
+	switch name {
+	case "little", "le":
+		return binary.LittleEndian, nil
+	case "big", "be":
+		return binary.BigEndian, nil
+	}
+	return nil, fmt.Errorf("unknown byte order %q, expected \"little\" or \"big\"", name)
+}
+
+// readUint reads an unsigned integer of the given size (1, 2, 4 or 8 bytes).
+func readUint(b []byte, order binary.ByteOrder) uint64 {
+	switch len(b) {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(order.Uint16(b))
+	case 4:
+		return uint64(order.Uint32(b))
+	}
+	return order.Uint64(b)
+}
+
+// writeUint writes the lower len(b) bytes of value to b.
+func writeUint(b []byte, order binary.ByteOrder, value uint64) {
+	switch len(b) {
+	case 1:
+		b[0] = byte(value)
+	case 2:
+		order.PutUint16(b, uint16(value))
+	case 4:
+		order.PutUint32(b, uint32(value))
+	default:
+		order.PutUint64(b, value)
+	}
+}
@@ -0,0 +1,112 @@
+package shmmodule
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// shared memory areas are files in /dev/shm on Linux,
+// which is where shm_open(3) creates them
+const sharedMemoryDir = "/dev/shm"
+
+func sharedMemoryPath(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return "", fmt.Errorf("invalid shared memory name: %q", name)
+	}
+	return filepath.Join(sharedMemoryDir, name), nil
+}
+
+// createRegion creates a new shared memory area. It fails if an area
+// with that name already exists, so the file that is removed when the
+// region is closed is always one that was created here.
+func createRegion(name string, size int) (*region, error) {
+	path, err := sharedMemoryPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("%s: size must be positive", path)
+	}
+	r, err := mapPath(path, size, os.O_CREATE|os.O_EXCL)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("shared memory area %q already exists", name)
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	release := r.release
+	r.release = func() error {
+		err := release()
+		os.Remove(path)
+		return err
+	}
+	return r, nil
+}
+
+// openRegion maps an existing shared memory area that was created
+// by another program. If size is 0, the whole area is mapped.
+func openRegion(name string, size int) (*region, error) {
+	path, err := sharedMemoryPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return mapPath(path, size, 0)
+}
+
+// mapFileRegion maps a file into memory. If size is 0, the whole file
+// is mapped; it must exist and must not be empty. Otherwise, the file is
+// created if it does not exist and extended if it is smaller than size.
+func mapFileRegion(path string, size int) (*region, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("%s: size must not be negative", path)
+	}
+	if size == 0 {
+		return mapPath(path, 0, 0)
+	}
+	return mapPath(path, size, os.O_CREATE)
+}
+
+func mapPath(path string, size int, flag int) (*region, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|flag, 0660)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // the mapping stays valid after the file is closed
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		size = int(info.Size())
+		if size == 0 {
+			return nil, fmt.Errorf("%s is empty", path)
+		}
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("%s: size must be positive", path)
+	}
+	if info.Size() < int64(size) {
+		if flag&os.O_CREATE == 0 {
+			return nil, fmt.Errorf("%s is only %d bytes large", path, info.Size())
+		}
+		if err := f.Truncate(int64(size)); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	return &region{
+		data: data,
+		release: func() error {
+			return syscall.Munmap(data)
+		},
+	}, nil
+}
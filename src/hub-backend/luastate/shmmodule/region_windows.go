@@ -0,0 +1,147 @@
+package shmmodule
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modkernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procOpenFileMapping = modkernel32.NewProc("OpenFileMappingW")
+	procVirtualQuery    = modkernel32.NewProc("VirtualQuery")
+)
+
+// memoryBasicInformation is the MEMORY_BASIC_INFORMATION structure
+// that is filled in by VirtualQuery.
+type memoryBasicInformation struct {
+	BaseAddress       uintptr
+	AllocationBase    uintptr
+	AllocationProtect uint32
+	PartitionId       uint16
+	RegionSize        uintptr
+	State             uint32
+	Protect           uint32
+	Type              uint32
+}
+
+// createRegion creates a new named file mapping that is backed by the
+// paging file. If a mapping with that name already exists, it is opened.
+func createRegion(name string, size int) (*region, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("size must be positive")
+	}
+	key, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFileMapping(syscall.InvalidHandle, nil, syscall.PAGE_READWRITE, 0, uint32(size), key)
+	if err != nil {
+		return nil, os.NewSyscallError("CreateFileMapping", err)
+	}
+	return mapView(h, size, nil)
+}
+
+// openRegion opens an existing named file mapping that was created by
+// another program. If size is 0, the whole mapping is mapped; its size
+// is then rounded up to a multiple of the page size.
+func openRegion(name string, size int) (*region, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("size must not be negative")
+	}
+	key, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	r1, _, e1 := procOpenFileMapping.Call(
+		uintptr(syscall.FILE_MAP_READ|syscall.FILE_MAP_WRITE),
+		0,
+		uintptr(unsafe.Pointer(key)))
+	if r1 == 0 {
+		return nil, os.NewSyscallError("OpenFileMapping", e1)
+	}
+	return mapView(syscall.Handle(r1), size, nil)
+}
+
+// mapFileRegion maps a file into memory. If size is 0, the whole file
+// is mapped; it must exist and must not be empty. Otherwise, the file is
+// created if it does not exist and extended if it is smaller than size.
+func mapFileRegion(path string, size int) (*region, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("%s: size must not be negative", path)
+	}
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	var createmode uint32 = syscall.OPEN_ALWAYS
+	if size == 0 {
+		createmode = syscall.OPEN_EXISTING
+	}
+	f, err := syscall.CreateFile(p,
+		syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE,
+		nil, createmode, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	if size == 0 {
+		var info syscall.ByHandleFileInformation
+		if err := syscall.GetFileInformationByHandle(f, &info); err != nil {
+			syscall.CloseHandle(f)
+			return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+		}
+		size = int(int64(info.FileSizeHigh)<<32 | int64(info.FileSizeLow))
+		if size == 0 {
+			syscall.CloseHandle(f)
+			return nil, fmt.Errorf("%s is empty", path)
+		}
+	}
+	h, err := syscall.CreateFileMapping(f, nil, syscall.PAGE_READWRITE, 0, uint32(size), nil)
+	if err != nil {
+		syscall.CloseHandle(f)
+		return nil, os.NewSyscallError("CreateFileMapping", err)
+	}
+	return mapView(h, size, func() { syscall.CloseHandle(f) })
+}
+
+// mapView maps size bytes of the file mapping h, or all of it if size is 0.
+// h (and whatever closeFile closes) is closed when the region is released.
+func mapView(h syscall.Handle, size int, closeFile func()) (*region, error) {
+	cleanup := func() {
+		syscall.CloseHandle(h)
+		if closeFile != nil {
+			closeFile()
+		}
+	}
+	addr, err := syscall.MapViewOfFile(h, syscall.FILE_MAP_READ|syscall.FILE_MAP_WRITE, 0, 0, uintptr(size))
+	if err != nil {
+		cleanup()
+		return nil, os.NewSyscallError("MapViewOfFile", err)
+	}
+	if size == 0 {
+		var info memoryBasicInformation
+		r1, _, e1 := procVirtualQuery.Call(addr, uintptr(unsafe.Pointer(&info)), unsafe.Sizeof(info))
+		if r1 == 0 {
+			syscall.UnmapViewOfFile(addr)
+			cleanup()
+			return nil, os.NewSyscallError("VirtualQuery", e1)
+		}
+		size = int(info.RegionSize)
+	}
+	var data []byte
+	header := (*reflect.SliceHeader)(unsafe.Pointer(&data))
+	header.Data = addr
+	header.Len = size
+	header.Cap = size
+	return &region{
+		data: data,
+		release: func() error {
+			err := syscall.UnmapViewOfFile(addr)
+			cleanup()
+			return err
+		},
+	}, nil
+}
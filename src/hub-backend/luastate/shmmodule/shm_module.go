@@ -1,89 +1,239 @@
 package shmmodule
 
 import (
-	"github.com/hidez8891/shm"
+	"encoding/binary"
+	"math"
+
 	lua "github.com/yuin/gopher-lua"
 )
 
-var sharedMemoryAreas map[string]*shm.Memory
-
-// Loader is called by luastate.go to provide the "hub" module
-// to the Lua environment.
-func Loader(L *lua.LState) int {
-	mod := L.SetFuncs(L.NewTable(), exports)
-	L.Push(mod)
-	return 1
+// Module holds the shared memory areas that have been created
+// or opened by one Lua state.
+type Module struct {
+	sharedMemoryAreas map[string]*region
 }
 
-func Preload(L *lua.LState) {
-	L.PreloadModule("shm", Loader)
+// Preload makes the "shm" module available to require() in the given Lua state.
+// The returned Module must be closed when the Lua state is closed.
+func Preload(L *lua.LState) *Module {
+	m := &Module{
+		sharedMemoryAreas: make(map[string]*region),
+	}
+	L.PreloadModule("shm", m.Loader)
+	return m
 }
 
-var exports = map[string]lua.LGFunction{
-	"create": shmCreate,
-	"write":  shmWrite,
-	"close":  shmClose,
+// Loader is called by gopher-lua to provide the "shm" module
+// to the Lua environment.
+func (m *Module) Loader(L *lua.LState) int {
+	mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"create":   m.shmCreate,
+		"open":     m.shmOpen,
+		"mapFile":  m.shmMapFile,
+		"read":     m.shmRead,
+		"write":    m.shmWrite,
+		"readInt":  m.shmReadInt,
+		"writeInt": m.shmWriteInt,
+		"close":    m.shmClose,
+	})
+	L.Push(mod)
+	return 1
 }
 
-func Reset() {
-	for _, v := range sharedMemoryAreas {
+// Close closes all shared memory areas that were created or opened through this module.
+func (m *Module) Close() {
+	for _, v := range m.sharedMemoryAreas {
 		v.Close()
 	}
-	sharedMemoryAreas = make(map[string]*shm.Memory)
+	m.sharedMemoryAreas = make(map[string]*region)
 }
 
-func shmCreate(L *lua.LState) int {
-	name := L.ToString(1)
-	size := int32(L.ToInt(2))
-
-	if _, ok := sharedMemoryAreas[name]; ok {
-		L.Push(lua.LFalse)
-		L.Push(lua.LString("already exists"))
-		return 2
+// HasCreatedAreas returns true if a shared memory area has been created
+// through this module, which another Lua state cannot create at the same time.
+func (m *Module) HasCreatedAreas() bool {
+	for _, r := range m.sharedMemoryAreas {
+		if r.created {
+			return true
+		}
 	}
+	return false
+}
 
-	s, err := shm.Create(name, size)
+// addRegion pushes the result of createRegion, openRegion or mapFileRegion
+// and remembers the region under the given name.
+func (m *Module) addRegion(L *lua.LState, name string, r *region, err error) int {
 	if err != nil {
 		L.Push(lua.LFalse)
 		L.Push(lua.LString(err.Error()))
 		return 2
 	}
-	sharedMemoryAreas[name] = s
+	m.sharedMemoryAreas[name] = r
 	L.Push(lua.LTrue)
 	L.Push(lua.LNil)
 	return 2
 }
 
-func shmClose(L *lua.LState) int {
+func (m *Module) checkNotExists(L *lua.LState, name string) bool {
+	if _, ok := m.sharedMemoryAreas[name]; ok {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString("already exists"))
+		return false
+	}
+	return true
+}
+
+// create(name, size) creates a new shared memory area.
+func (m *Module) shmCreate(L *lua.LState) int {
 	name := L.ToString(1)
-	mem, ok := sharedMemoryAreas[name]
+	size := L.ToInt(2)
+
+	if !m.checkNotExists(L, name) {
+		return 2
+	}
+	r, err := createRegion(name, size)
+	if err == nil {
+		r.created = true
+	}
+	return m.addRegion(L, name, r, err)
+}
+
+// open(name, [size]) opens a shared memory area that was created by another program.
+func (m *Module) shmOpen(L *lua.LState) int {
+	name := L.CheckString(1)
+	size := L.OptInt(2, 0)
+
+	if !m.checkNotExists(L, name) {
+		return 2
+	}
+	r, err := openRegion(name, size)
+	return m.addRegion(L, name, r, err)
+}
+
+// mapFile(name, path, [size]) maps a file into memory. The file can then
+// be accessed like a shared memory area with the given name.
+// If the size is omitted or 0, the whole existing file is mapped.
+func (m *Module) shmMapFile(L *lua.LState) int {
+	name := L.CheckString(1)
+	path := L.CheckString(2)
+	size := L.OptInt(3, 0)
+
+	if !m.checkNotExists(L, name) {
+		return 2
+	}
+	r, err := mapFileRegion(path, size)
+	return m.addRegion(L, name, r, err)
+}
+
+func (m *Module) shmClose(L *lua.LState) int {
+	name := L.ToString(1)
+	mem, ok := m.sharedMemoryAreas[name]
 	if !ok {
 		L.Push(lua.LFalse)
 		return 1
 	}
 	mem.Close()
-	delete(sharedMemoryAreas, name)
+	delete(m.sharedMemoryAreas, name)
 	L.Push(lua.LTrue)
 	return 1
 }
 
-func shmWrite(L *lua.LState) int {
+func (m *Module) shmWrite(L *lua.LState) int {
 	name := L.ToString(1)
 	offset := L.ToInt64(2)
 	value := L.ToString(3)
 
-	mem, ok := sharedMemoryAreas[name]
+	mem, ok := m.sharedMemoryAreas[name]
 	if !ok {
 		L.Push(lua.LFalse)
 		return 1
 	}
+	if offset < 0 || offset >= int64(len(mem.data)) {
+		L.Push(lua.LNumber(0))
+		L.Push(lua.LString("EOF"))
+		return 2
+	}
 
-	n, err := mem.WriteAt([]byte(value), offset)
+	n := copy(mem.data[offset:], value)
 	L.Push(lua.LNumber(n))
-	if err != nil {
+	L.Push(lua.LNil)
+	return 2
+}
+
+// read(name, offset, length) returns length bytes as a string.
+func (m *Module) shmRead(L *lua.LState) int {
+	name := L.CheckString(1)
+	offset := L.CheckInt64(2)
+	length := L.CheckInt(3)
+
+	mem, ok := m.sharedMemoryAreas[name]
+	if !ok {
+		L.Push(lua.LNil)
+		L.Push(lua.LString("no such shared memory area"))
+		return 2
+	}
+	if err := mem.checkRange(offset, length); err != nil {
+		L.Push(lua.LNil)
 		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(mem.data[offset : offset+int64(length)]))
+	return 1
+}
+
+// checkIntArgs checks the (name, offset, size) arguments of readInt and writeInt
+// and the byte order argument at position orderArg. It returns the bytes of the integer.
+func (m *Module) checkIntArgs(L *lua.LState, orderArg int) ([]byte, binary.ByteOrder) {
+	name := L.CheckString(1)
+	offset := L.CheckInt64(2)
+	size := L.CheckInt(3)
+	if size != 1 && size != 2 && size != 4 && size != 8 {
+		L.ArgError(3, "size must be 1, 2, 4 or 8")
+	}
+	order, err := byteOrder(L.OptString(orderArg, "little"))
+	if err != nil {
+		L.ArgError(orderArg, err.Error())
+	}
+
+	mem, ok := m.sharedMemoryAreas[name]
+	if !ok {
+		L.ArgError(1, "no such shared memory area")
+	}
+	if err := mem.checkRange(offset, size); err != nil {
+		L.ArgError(2, err.Error())
+	}
+	return mem.data[offset : offset+int64(size)], order
+}
+
+// readInt(name, offset, size, [byteOrder, [signed]]) reads an integer of
+// 1, 2, 4 or 8 bytes. byteOrder is "little" (default) or "big".
+func (m *Module) shmReadInt(L *lua.LState) int {
+	b, order := m.checkIntArgs(L, 4)
+	signed := L.OptBool(5, false)
+
+	value := readUint(b, order)
+	if signed {
+		// sign-extend to 64 bits
+		shift := uint(64 - 8*len(b))
+		L.Push(lua.LNumber(int64(value<<shift) >> shift))
 	} else {
-		L.Push(lua.LNil)
+		L.Push(lua.LNumber(value))
 	}
-	return 2
+	return 1
+}
+
+// writeInt(name, offset, size, value, [byteOrder]) writes an integer of
+// 1, 2, 4 or 8 bytes. Negative values are written in two's complement.
+func (m *Module) shmWriteInt(L *lua.LState) int {
+	b, order := m.checkIntArgs(L, 5)
+	value := float64(L.CheckNumber(4))
+
+	var bits uint64
+	if value < 0 {
+		bits = uint64(int64(math.Trunc(value)))
+	} else {
+		bits = uint64(math.Trunc(value))
+	}
+	writeUint(b, order, bits)
+	L.Push(lua.LTrue)
+	return 1
 }
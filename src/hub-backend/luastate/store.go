@@ -0,0 +1,290 @@
+package luastate
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"dcs-bios.a10c.de/dcs-bios-hub/configstore"
+	"dcs-bios.a10c.de/dcs-bios-hub/jsonapi"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// storeWriteDelay is the time a script store waits after a change before
+// it is written to disk, so a script that changes a value many times in a
+// row (e.g. while a knob is turned) does not write the file every time.
+const storeWriteDelay = 1 * time.Second
+
+// scriptStore holds the persistent values of a script (see hub.store).
+// Stores are loaded the first time they are used and kept in memory,
+// so they survive reloading the script.
+type scriptStore struct {
+	script     string
+	values     map[string]interface{}
+	writeTimer *time.Timer // non-nil while a write is pending
+}
+
+// storedValues is the format of the JSON file of a script store.
+type storedValues struct {
+	Script string                 `json:"script"`
+	Values map[string]interface{} `json:"values"`
+}
+
+var scriptStoresLock sync.Mutex // protects scriptStores and the values of all stores
+var scriptStores = make(map[string]*scriptStore)
+
+// scriptStoreWriteLock makes sure that the files are written in the same
+// order as the changes were made.
+var scriptStoreWriteLock sync.Mutex
+
+// storeFileName returns the name of the file that holds the values of a script.
+// It contains the name of the script for humans and a hash of the full path.
+func storeFileName(script string) string {
+	if script == "" {
+		return filepath.Join("scriptstore", "console.json")
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(script)))
+	name := strings.TrimSuffix(filepath.Base(script), filepath.Ext(script))
+	return filepath.Join("scriptstore", fmt.Sprintf("%s-%08x.json", name, h.Sum32()))
+}
+
+// getScriptStore returns the store of a script, loading it if necessary.
+// The caller must hold scriptStoresLock.
+func getScriptStore(script string) *scriptStore {
+	if st, ok := scriptStores[script]; ok {
+		return st
+	}
+	st := &scriptStore{
+		script: script,
+		values: make(map[string]interface{}),
+	}
+	if persistentState {
+		var stored storedValues
+		if err := configstore.Load(storeFileName(script), &stored); err == nil && stored.Values != nil {
+			st.values = stored.Values
+		}
+	}
+	scriptStores[script] = st
+	return st
+}
+
+// changed schedules writing the store to disk.
+// The caller must hold scriptStoresLock.
+func (st *scriptStore) changed() {
+	if st.writeTimer == nil && persistentState {
+		st.writeTimer = time.AfterFunc(storeWriteDelay, func() {
+			writeScriptStore(st)
+		})
+	}
+}
+
+// writeScriptStore writes the values of a store to its file.
+func writeScriptStore(st *scriptStore) {
+	scriptStoreWriteLock.Lock()
+	defer scriptStoreWriteLock.Unlock()
+
+	scriptStoresLock.Lock()
+	if st.writeTimer == nil {
+		// already written by flushScriptStores
+		scriptStoresLock.Unlock()
+		return
+	}
+	st.writeTimer.Stop()
+	st.writeTimer = nil
+	stored := storedValues{
+		Script: st.script,
+		Values: st.copyValues(),
+	}
+	scriptStoresLock.Unlock()
+
+	if err := configstore.Store(storeFileName(st.script), stored); err != nil {
+		logScriptError(st.script, "could not save hub.store: ", err)
+	}
+}
+
+// copyValues returns a shallow copy of the values of the store. This is
+// sufficient because values are replaced, but never modified in place.
+// The caller must hold scriptStoresLock.
+func (st *scriptStore) copyValues() map[string]interface{} {
+	values := make(map[string]interface{}, len(st.values))
+	for key, value := range st.values {
+		values[key] = value
+	}
+	return values
+}
+
+// flushScriptStores writes all stores that have pending changes.
+func flushScriptStores() {
+	scriptStoresLock.Lock()
+	var pending []*scriptStore
+	for _, st := range scriptStores {
+		if st.writeTimer != nil {
+			pending = append(pending, st)
+		}
+	}
+	scriptStoresLock.Unlock()
+
+	for _, st := range pending {
+		writeScriptStore(st)
+	}
+}
+
+// storeModule returns the hub.store table of a script.
+func (s *script) storeModule(L *lua.LState) *lua.LTable {
+	return L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"get":    s.storeGet,
+		"set":    s.storeSet,
+		"delete": s.storeDelete,
+		"keys":   s.storeKeys,
+	})
+}
+
+// hub.store.get(key, [default])
+// returns the stored value, or default if there is none.
+func (s *script) storeGet(L *lua.LState) int {
+	key := L.CheckString(1)
+
+	scriptStoresLock.Lock()
+	value, ok := getScriptStore(s.path).values[key]
+	scriptStoresLock.Unlock()
+
+	if !ok || value == nil {
+		L.Push(L.Get(2))
+		return 1
+	}
+	L.Push(jsonValueToLua(L, value))
+	return 1
+}
+
+// hub.store.set(key, value)
+// stores a value that can be represented in JSON (booleans, numbers,
+// strings and tables of these). Setting a key to nil deletes it.
+func (s *script) storeSet(L *lua.LState) int {
+	key := L.CheckString(1)
+	value, err := luaToJsonValue(L.Get(2))
+	if err != nil {
+		L.ArgError(2, err.Error())
+	}
+
+	scriptStoresLock.Lock()
+	defer scriptStoresLock.Unlock()
+	st := getScriptStore(s.path)
+	if value == nil {
+		delete(st.values, key)
+	} else {
+		st.values[key] = value
+	}
+	st.changed()
+	return 0
+}
+
+// hub.store.delete(key)
+func (s *script) storeDelete(L *lua.LState) int {
+	key := L.CheckString(1)
+
+	scriptStoresLock.Lock()
+	defer scriptStoresLock.Unlock()
+	st := getScriptStore(s.path)
+	if _, ok := st.values[key]; ok {
+		delete(st.values, key)
+		st.changed()
+	}
+	return 0
+}
+
+// hub.store.keys()
+// returns a table with all keys that have a value.
+func (s *script) storeKeys(L *lua.LState) int {
+	scriptStoresLock.Lock()
+	defer scriptStoresLock.Unlock()
+	keys := L.NewTable()
+	for key := range getScriptStore(s.path).values {
+		keys.Append(lua.LString(key))
+	}
+	L.Push(keys)
+	return 1
+}
+
+type GetScriptStoreRequest struct {
+	Script string `json:"script"`
+}
+
+// ScriptStore is the content of the store of a script.
+type ScriptStore struct {
+	Script string                 `json:"script"`
+	Values map[string]interface{} `json:"values"`
+}
+
+// HandleGetScriptStoreRequest returns the stored values of a script.
+// Script is the path of the script as shown in the script list,
+// or empty for the Lua console.
+func HandleGetScriptStoreRequest(req *GetScriptStoreRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+
+	scriptStoresLock.Lock()
+	result := ScriptStore{
+		Script: req.Script,
+		Values: getScriptStore(req.Script).copyValues(),
+	}
+	scriptStoresLock.Unlock()
+
+	responseCh <- result
+}
+
+type SetScriptStoreValueRequest struct {
+	Script string          `json:"script"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value"`
+}
+
+// HandleSetScriptStoreValueRequest changes a stored value of a script.
+// If the value is missing or null, the key is deleted.
+func HandleSetScriptStoreValueRequest(req *SetScriptStoreValueRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+
+	if req.Key == "" {
+		responseCh <- jsonapi.ErrorResult{
+			Message: "missing key",
+			Code:    400,
+		}
+		return
+	}
+	var value interface{}
+	if len(req.Value) > 0 {
+		if err := json.Unmarshal(req.Value, &value); err != nil {
+			responseCh <- jsonapi.ErrorResult{
+				Message: "invalid value: " + err.Error(),
+				Code:    400,
+			}
+			return
+		}
+	}
+
+	scriptStoresLock.Lock()
+	st := getScriptStore(req.Script)
+	if value == nil {
+		delete(st.values, req.Key)
+	} else {
+		st.values[req.Key] = value
+	}
+	st.changed()
+	scriptStoresLock.Unlock()
+
+	responseCh <- jsonapi.SuccessResult{
+		Message: "ok",
+	}
+}
+
+func registerScriptStoreApiCalls(jsonAPI *jsonapi.JsonApi) {
+	jsonAPI.RegisterType("get_script_store", GetScriptStoreRequest{})
+	jsonAPI.RegisterApiCall("get_script_store", HandleGetScriptStoreRequest)
+	jsonAPI.RegisterType("script_store", ScriptStore{})
+
+	jsonAPI.RegisterType("set_script_store_value", SetScriptStoreValueRequest{})
+	jsonAPI.RegisterApiCall("set_script_store_value", HandleSetScriptStoreValueRequest)
+}
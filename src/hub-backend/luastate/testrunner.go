@@ -0,0 +1,583 @@
+package luastate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dcs-bios.a10c.de/dcs-bios-hub/exportdataparser"
+	"dcs-bios.a10c.de/dcs-bios-hub/jsonapi"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// persistentState is set to false by the test runner,
+// so tests do not change hub.store values or virtual control
+// allocations in the configuration directory.
+var persistentState = true
+
+// testCaseTimeLimit is the maximum time a single test case may take.
+const testCaseTimeLimit = 30 * time.Second
+
+// runScriptTestsTimeLimit is the maximum time the run_script_tests API call
+// waits for the test subcommand to finish.
+const runScriptTestsTimeLimit = 5 * time.Minute
+
+// ScriptTestResults are the results of running a test file
+// against a hub script. If the test file could not be loaded,
+// Error is set and Cases is empty.
+type ScriptTestResults struct {
+	Script   string           `json:"script"`
+	Tests    string           `json:"tests"`
+	Error    string           `json:"error,omitempty"`
+	Cases    []ScriptTestCase `json:"cases"`
+	Duration float64          `json:"duration"` // in seconds
+	JUnitXML string           `json:"junitXml,omitempty"`
+}
+
+// ScriptTestCase is the result of a single test case.
+// Output contains the script log and everything printed by the test.
+type ScriptTestCase struct {
+	Name       string   `json:"name"`
+	Passed     bool     `json:"passed"`
+	Failure    string   `json:"failure,omitempty"`
+	StackTrace string   `json:"stackTrace,omitempty"`
+	Output     []string `json:"output"`
+	Duration   float64  `json:"duration"` // in seconds
+}
+
+// Failed returns true if the test file could not be loaded or a test case failed.
+func (r *ScriptTestResults) Failed() bool {
+	if r.Error != "" {
+		return true
+	}
+	for _, c := range r.Cases {
+		if !c.Passed {
+			return true
+		}
+	}
+	return false
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnitXML writes the results in the JUnit XML format
+// that is understood by most CI systems.
+func (r *ScriptTestResults) WriteJUnitXML(w io.Writer) error {
+	suite := junitTestSuite{
+		Name: filepath.Base(r.Tests),
+		Time: fmt.Sprintf("%.3f", r.Duration),
+	}
+	if r.Error != "" {
+		suite.Errors++
+		suite.Cases = append(suite.Cases, junitTestCase{
+			Name:      "load",
+			Classname: suite.Name,
+			Time:      "0.000",
+			Error:     &junitMessage{Message: r.Error},
+		})
+	}
+	for _, c := range r.Cases {
+		tc := junitTestCase{
+			Name:      c.Name,
+			Classname: suite.Name,
+			Time:      fmt.Sprintf("%.3f", c.Duration),
+			SystemOut: strings.Join(c.Output, "\n"),
+		}
+		if !c.Passed {
+			suite.Failures++
+			tc.Failure = &junitMessage{Message: c.Failure, Text: c.StackTrace}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	suite.Tests = len(suite.Cases)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// testRunner holds the state of a test run. The test file is executed in
+// its own Lua state, which provides the "test" table. Every test case gets
+// a freshly loaded instance of the script under test.
+type testRunner struct {
+	scriptPath string
+	L          *lua.LState
+	cases      []registeredTestCase
+
+	script  *script // instance of the script for the current test case
+	sim     *exportdataparser.DataBuffer
+	sent    []string // commands that would have been sent to DCS
+	output  []string // printed by the test file
+	caseCtx context.Context
+}
+
+type registeredTestCase struct {
+	name string
+	fn   *lua.LFunction
+}
+
+// RunScriptTests executes the test cases defined in the Lua file testsPath
+// against the hub script at scriptPath.
+//
+// The test runner replaces the cockpit state, ExportDataBuffer, the command
+// channels and the script list, so it must not be used while the hub is
+// running. The hub executable provides it as the "test" subcommand.
+func RunScriptTests(scriptPath string, testsPath string) ScriptTestResults {
+	start := time.Now()
+	results := ScriptTestResults{
+		Script: scriptPath,
+		Tests:  testsPath,
+		Cases:  make([]ScriptTestCase, 0),
+	}
+	persistentState = false
+
+	r := &testRunner{scriptPath: scriptPath}
+	r.L = lua.NewState()
+	defer r.L.Close()
+	r.L.SetGlobal("print", r.L.NewFunction(r.print))
+	r.L.SetGlobal("test", r.L.SetFuncs(r.L.NewTable(), map[string]lua.LGFunction{
+		"case":                 r.registerCase,
+		"simFrame":             r.simFrame,
+		"input":                r.input,
+		"wait":                 r.wait,
+		"commands":             r.commands,
+		"panelInteger":         r.panelInteger,
+		"panelString":          r.panelString,
+		"scriptGlobal":         r.scriptGlobal,
+		"assertEquals":         r.assertEquals,
+		"assertPanelInteger":   r.assertPanelInteger,
+		"assertPanelString":    r.assertPanelString,
+		"assertCommandSent":    r.assertCommandSent,
+		"assertNoCommandsSent": r.assertNoCommandsSent,
+	}))
+
+	if err := r.L.DoFile(testsPath); err != nil {
+		results.Error = err.Error()
+	} else {
+		for _, tc := range r.cases {
+			results.Cases = append(results.Cases, r.runCase(tc))
+		}
+	}
+	results.Duration = time.Since(start).Seconds()
+	return results
+}
+
+func (r *testRunner) runCase(tc registeredTestCase) ScriptTestCase {
+	start := time.Now()
+	result := ScriptTestCase{Name: tc.name}
+
+	r.sim = exportdataparser.NewDataBuffer(ControlReferenceStore)
+	SetSimDataBuffer(r.sim.Copy())
+	ExportDataBuffer = exportdataparser.NewDataBuffer(ControlReferenceStore)
+	SetCommandQueueSize(cap(SimCommandChannel))
+	r.sent = nil
+	r.output = nil
+
+	scriptLogLock.Lock()
+	delete(scriptLogs, r.scriptPath)
+	scriptLogLock.Unlock()
+
+	s, err := loadScript(r.scriptPath, ioutil.Discard)
+	luaLock.Lock()
+	scriptList = []ScriptListEntry{{Path: r.scriptPath, Enabled: true, State: ScriptStateRunning}}
+	if s != nil {
+		runningScripts[r.scriptPath] = s
+	}
+	luaLock.Unlock()
+	r.script = s
+
+	if err != nil {
+		result.Failure = "could not load the script: " + err.Error()
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), testCaseTimeLimit)
+		r.caseCtx = ctx
+		r.L.SetContext(ctx)
+		err = r.L.CallByParam(lua.P{
+			Fn:      tc.fn,
+			NRet:    0,
+			Protect: true,
+		})
+		r.L.RemoveContext()
+		cancel()
+		r.pump()
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			result.Failure = apiErr.Object.String()
+			result.StackTrace = apiErr.StackTrace
+		} else if err != nil {
+			result.Failure = err.Error()
+		}
+	}
+
+	luaLock.Lock()
+	stopScript(r.scriptPath)
+	scriptList = nil
+	luaLock.Unlock()
+	r.script = nil
+
+	scriptLogLock.Lock()
+	if ring, ok := scriptLogs[r.scriptPath]; ok {
+		for _, msg := range ring.copyEntries() {
+			line := msg.Level + ": " + msg.Message
+			if msg.Repeated > 0 {
+				line += fmt.Sprintf(" (repeated %d times)", msg.Repeated)
+			}
+			result.Output = append(result.Output, line)
+			if msg.Level == ScriptLogLevelError && result.Failure == "" {
+				// errors in callbacks are only logged by the hub,
+				// but should not go unnoticed in a test
+				result.Failure = "script error: " + msg.Message
+				result.StackTrace = msg.StackTrace
+			}
+		}
+	}
+	scriptLogLock.Unlock()
+	result.Output = append(result.Output, r.output...)
+
+	result.Passed = result.Failure == ""
+	result.Duration = time.Since(start).Seconds()
+	return result
+}
+
+// pump processes the commands that the script has sent to DCS or injected
+// as input commands, like the main loop of the hub does.
+func (r *testRunner) pump() {
+	for {
+		select {
+		case cmd := <-SimCommandChannel:
+			r.sent = append(r.sent, cmd)
+		case ic := <-InjectedCommandChannel:
+			if !NotifyInputCallbacks(ic.Command, ic.Source) {
+				r.sent = append(r.sent, ic.Command)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (r *testRunner) print(L *lua.LState) int {
+	top := L.GetTop()
+	parts := make([]string, top)
+	for i := 1; i <= top; i++ {
+		parts[i-1] = L.ToStringMeta(L.Get(i)).String()
+	}
+	r.output = append(r.output, "test: "+strings.Join(parts, "\t"))
+	return 0
+}
+
+// test.case(name, fn)
+// registers a test case.
+func (r *testRunner) registerCase(L *lua.LState) int {
+	r.cases = append(r.cases, registeredTestCase{
+		name: L.CheckString(1),
+		fn:   L.CheckFunction(2),
+	})
+	return 0
+}
+
+// checkRunning raises an error if it is called outside of a test case.
+func (r *testRunner) checkRunning(L *lua.LState) {
+	if r.script == nil {
+		L.RaiseError("this function can only be called from a test case")
+	}
+}
+
+// test.simFrame(values)
+// simulates an update from DCS. values is a table that maps control
+// identifiers to integer or string values. The data is copied to the
+// panel data and the output callbacks are called like in the hub.
+func (r *testRunner) simFrame(L *lua.LState) int {
+	r.checkRunning(L)
+	values := L.OptTable(1, L.NewTable())
+
+	r.sim.ClearDirtyFlags()
+	values.ForEach(func(key lua.LValue, value lua.LValue) {
+		id := key.String()
+		ok := false
+		switch v := value.(type) {
+		case lua.LNumber:
+			ok = r.sim.SetIntegerValue(id, int(v))
+		case lua.LString:
+			ok = r.sim.SetCStringValue(id, string(v))
+		}
+		if !ok {
+			L.RaiseError("cannot set %s to %s", id, value.String())
+		}
+	})
+
+	simData := r.sim.Copy()
+	SetSimDataBuffer(simData)
+	for _, v := range simData.BinaryData {
+		ExportDataBuffer.SetUint16(v.Address, v.Data)
+	}
+	NotifyOutputCallbacks()
+	r.pump()
+	return 0
+}
+
+// test.input(cmd, arg, [source])
+// simulates a command from a panel. Returns true if it was handled by the
+// script, otherwise the command is added to the commands sent to DCS.
+func (r *testRunner) input(L *lua.LState) int {
+	r.checkRunning(L)
+	cmd := L.CheckString(1)
+	arg := L.CheckString(2)
+	source := L.OptString(3, "test")
+
+	handled := NotifyInputCallbacks(cmd+" "+arg, source)
+	if !handled {
+		r.sent = append(r.sent, cmd+" "+arg)
+	}
+	r.pump()
+	L.Push(lua.LBool(handled))
+	return 1
+}
+
+// test.wait(milliseconds)
+// lets the timers and command sequences of the script run.
+func (r *testRunner) wait(L *lua.LState) int {
+	r.checkRunning(L)
+	deadline := time.Now().Add(time.Duration(L.CheckInt(1)) * time.Millisecond)
+	for {
+		r.pump()
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+		if remaining > 10*time.Millisecond {
+			remaining = 10 * time.Millisecond
+		}
+		select {
+		case <-time.After(remaining):
+		case <-r.caseCtx.Done():
+			L.RaiseError("the test case took longer than %v", testCaseTimeLimit)
+		}
+	}
+	return 0
+}
+
+// test.commands()
+// returns the commands sent to DCS since the last call as a table of
+// strings ("COMMAND ARGUMENT").
+func (r *testRunner) commands(L *lua.LState) int {
+	r.checkRunning(L)
+	r.pump()
+	sent := L.NewTable()
+	for _, cmd := range r.sent {
+		sent.Append(lua.LString(cmd))
+	}
+	r.sent = nil
+	L.Push(sent)
+	return 1
+}
+
+// test.panelInteger(id)
+// returns the integer value that would be sent to the panels.
+func (r *testRunner) panelInteger(L *lua.LState) int {
+	r.checkRunning(L)
+	L.Push(lua.LNumber(ExportDataBuffer.GetIntegerValue(L.CheckString(1))))
+	return 1
+}
+
+// test.panelString(id)
+// returns the string value that would be sent to the panels.
+func (r *testRunner) panelString(L *lua.LState) int {
+	r.checkRunning(L)
+	L.Push(lua.LString(ExportDataBuffer.GetCStringValue(L.CheckString(1))))
+	return 1
+}
+
+// test.scriptGlobal(name)
+// returns a copy of a global variable of the script under test.
+// Only values that can be stored with hub.store can be copied.
+func (r *testRunner) scriptGlobal(L *lua.LState) int {
+	r.checkRunning(L)
+	name := L.CheckString(1)
+
+	r.script.lock.Lock()
+	value, err := luaToJsonValue(r.script.L.GetGlobal(name))
+	r.script.lock.Unlock()
+	if err != nil {
+		L.RaiseError("cannot copy %s: %v", name, err)
+	}
+	L.Push(jsonValueToLua(L, value))
+	return 1
+}
+
+// fail raises an assertion error with an optional message
+// given as the argument at position msgArg.
+func fail(L *lua.LState, msgArg int, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if prefix := L.OptString(msgArg, ""); prefix != "" {
+		msg = prefix + ": " + msg
+	}
+	L.RaiseError("%s", msg)
+}
+
+// test.assertEquals(actual, expected, [message])
+// compares numbers, strings and booleans, and tables by their contents.
+func (r *testRunner) assertEquals(L *lua.LState) int {
+	actual, _ := json.Marshal(mustJsonValue(L, 1))
+	expected, _ := json.Marshal(mustJsonValue(L, 2))
+	if !bytes.Equal(actual, expected) {
+		fail(L, 3, "expected %s, got %s", expected, actual)
+	}
+	return 0
+}
+
+func mustJsonValue(L *lua.LState, n int) interface{} {
+	value, err := luaToJsonValue(L.Get(n))
+	if err != nil {
+		L.ArgError(n, err.Error())
+	}
+	return value
+}
+
+// test.assertPanelInteger(id, expected, [message])
+func (r *testRunner) assertPanelInteger(L *lua.LState) int {
+	r.checkRunning(L)
+	id := L.CheckString(1)
+	expected := L.CheckInt(2)
+	if actual := ExportDataBuffer.GetIntegerValue(id); actual != expected {
+		fail(L, 3, "expected %s to be %d, got %d", id, expected, actual)
+	}
+	return 0
+}
+
+// test.assertPanelString(id, expected, [message])
+func (r *testRunner) assertPanelString(L *lua.LState) int {
+	r.checkRunning(L)
+	id := L.CheckString(1)
+	expected := L.CheckString(2)
+	if actual := ExportDataBuffer.GetCStringValue(id); actual != expected {
+		fail(L, 3, "expected %s to be %q, got %q", id, expected, actual)
+	}
+	return 0
+}
+
+// test.assertCommandSent(command, [message])
+// checks that a command ("COMMAND ARGUMENT") has been sent to DCS
+// and removes it from the list of sent commands.
+func (r *testRunner) assertCommandSent(L *lua.LState) int {
+	r.checkRunning(L)
+	command := L.CheckString(1)
+	r.pump()
+	for i, cmd := range r.sent {
+		if cmd == command {
+			r.sent = append(r.sent[:i], r.sent[i+1:]...)
+			return 0
+		}
+	}
+	fail(L, 2, "expected command %q, sent commands: %q", command, r.sent)
+	return 0
+}
+
+// test.assertNoCommandsSent([message])
+func (r *testRunner) assertNoCommandsSent(L *lua.LState) int {
+	r.checkRunning(L)
+	r.pump()
+	if len(r.sent) > 0 {
+		fail(L, 1, "expected no commands, sent commands: %q", r.sent)
+	}
+	return 0
+}
+
+type RunScriptTestsRequest struct {
+	Script string `json:"script"`
+	Tests  string `json:"tests"`
+}
+
+// HandleRunScriptTestsRequest runs the tests of a hub script. As the test
+// runner cannot share the Lua environment with the running scripts, the
+// tests are run by the "test" subcommand of the hub executable.
+func HandleRunScriptTestsRequest(ctx context.Context, req *RunScriptTestsRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
+
+	if req.Script == "" || req.Tests == "" {
+		responseCh <- jsonapi.ErrorResult{
+			Message: "script and tests are required",
+			Code:    400,
+		}
+		return
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		responseCh <- jsonapi.ErrorResult{
+			Message: err.Error(),
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, runScriptTestsTimeLimit)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, executable, "test", "-json", req.Script, req.Tests)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	runErr := cmd.Run()
+
+	var results ScriptTestResults
+	if err := json.Unmarshal(stdout.Bytes(), &results); err != nil {
+		if runErr == nil {
+			runErr = err
+		}
+		responseCh <- jsonapi.ErrorResult{
+			Message: fmt.Sprintf("could not run tests: %v %s", runErr, strings.TrimSpace(stderr.String())),
+		}
+		return
+	}
+
+	var junit bytes.Buffer
+	results.WriteJUnitXML(&junit)
+	results.JUnitXML = junit.String()
+	responseCh <- results
+}
+
+func registerScriptTestApiCalls(jsonAPI *jsonapi.JsonApi) {
+	jsonAPI.RegisterType("run_script_tests", RunScriptTestsRequest{})
+	// the handler enforces runScriptTestsTimeLimit itself
+	jsonAPI.RegisterApiCallWithTimeout("run_script_tests", HandleRunScriptTestsRequest, 0)
+	jsonAPI.RegisterType("script_test_results", ScriptTestResults{})
+}
@@ -0,0 +1,130 @@
+package luastate
+
+import (
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// minTimerInterval is the smallest delay accepted by
+// hub.setTimeout and hub.setInterval.
+const minTimerInterval = 10 * time.Millisecond
+
+// hubStartTime is the reference point for hub.now().
+var hubStartTime = time.Now()
+
+// luaTimer is a timer created by hub.setTimeout or hub.setInterval.
+type luaTimer struct {
+	fn       *lua.LFunction
+	interval time.Duration // zero for timers created by hub.setTimeout
+	timer    *time.Timer
+}
+
+// setTimeout(fn, milliseconds)
+// calls fn once after the given delay and returns the timer id.
+func (s *script) setTimeout(L *lua.LState) int {
+	fn := L.CheckFunction(1)
+	delay := timerDelay(L.CheckNumber(2))
+	L.Push(lua.LNumber(s.startTimer(fn, delay, 0)))
+	return 1
+}
+
+// setInterval(fn, milliseconds)
+// calls fn repeatedly with the given interval and returns the timer id.
+// The interval is measured from the end of one call to the start of the next.
+func (s *script) setInterval(L *lua.LState) int {
+	fn := L.CheckFunction(1)
+	interval := timerDelay(L.CheckNumber(2))
+	L.Push(lua.LNumber(s.startTimer(fn, interval, interval)))
+	return 1
+}
+
+// clearTimer(id)
+// stops a timer created by setTimeout or setInterval.
+// Returns true if the timer was still active.
+func (s *script) clearTimer(L *lua.LState) int {
+	id := L.CheckInt(1)
+	t, ok := s.timers[id]
+	if ok {
+		t.timer.Stop()
+		delete(s.timers, id)
+	}
+	L.Push(lua.LBool(ok))
+	return 1
+}
+
+// now()
+// returns the number of milliseconds since the DCS-BIOS Hub was started.
+func now(L *lua.LState) int {
+	L.Push(lua.LNumber(time.Since(hubStartTime).Seconds() * 1000))
+	return 1
+}
+
+func timerDelay(milliseconds lua.LNumber) time.Duration {
+	delay := time.Duration(float64(milliseconds) * float64(time.Millisecond))
+	if delay < minTimerInterval {
+		return minTimerInterval
+	}
+	return delay
+}
+
+// startTimer schedules fn to be called after delay.
+// The caller must hold s.lock.
+func (s *script) startTimer(fn *lua.LFunction, delay time.Duration, interval time.Duration) int {
+	s.nextTimerID++
+	id := s.nextTimerID
+	t := &luaTimer{
+		fn:       fn,
+		interval: interval,
+	}
+	s.timers[id] = t
+	t.timer = time.AfterFunc(delay, func() { s.runTimer(id) })
+	return id
+}
+
+// runTimer calls the function of a timer. If the timer was created by
+// setInterval, it is scheduled again after the function returns.
+func (s *script) runTimer(id int) {
+	var incidents []string
+	defer func() { reportIncidents(s, incidents) }()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t, ok := s.timers[id]
+	if !ok || s.isClosed() {
+		return
+	}
+	if t.interval == 0 {
+		delete(s.timers, id)
+	}
+
+	err := s.withTimeLimit(getCallbackTimeLimit(), func() error {
+		return s.L.CallByParam(lua.P{
+			Fn:      t.fn,
+			NRet:    0,
+			Protect: true,
+		})
+	})
+	if _, isTimeLimitError := err.(timeLimitError); isTimeLimitError {
+		delete(s.timers, id)
+		incidents = append(incidents, "timer "+callbackLocation(t.fn)+" disabled: "+err.Error())
+		return
+	}
+	if err != nil {
+		logScriptError(s.path, "timer: ", err)
+	}
+
+	// the timer may have been cleared by its own function
+	if _, active := s.timers[id]; active && t.interval > 0 {
+		t.timer.Reset(t.interval)
+	}
+}
+
+// stopTimers stops all timers of the script.
+// The caller must hold s.lock.
+func (s *script) stopTimers() {
+	for id, t := range s.timers {
+		t.timer.Stop()
+		delete(s.timers, id)
+	}
+}
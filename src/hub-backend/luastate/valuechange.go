@@ -0,0 +1,121 @@
+package luastate
+
+import (
+	"fmt"
+	"time"
+
+	"dcs-bios.a10c.de/dcs-bios-hub/controlreference"
+	"dcs-bios.a10c.de/dcs-bios-hub/exportdataparser"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// valueChangeCallback is a function registered with hub.onSimValueChanged.
+type valueChangeCallback struct {
+	id     string
+	output controlreference.Output
+	fn     *lua.LFunction
+	value  lua.LValue // the most recent value passed to fn
+}
+
+// onSimValueChanged(id, fn)
+// registers a function that is called with the new and the old value
+// whenever the value of a control in the sim data changes.
+// Integer outputs are preferred over string outputs.
+// Returns false if the control does not exist or has no outputs.
+func (s *script) onSimValueChanged(L *lua.LState) int {
+	id := L.CheckString(1)
+	fn := L.CheckFunction(2)
+
+	var element *controlreference.IOElement
+	if ControlReferenceStore != nil {
+		element = ControlReferenceStore.GetIOElementByIdentifier(id)
+	}
+	if element == nil || len(element.Outputs) == 0 {
+		L.Push(lua.LFalse)
+		return 1
+	}
+	output := element.Outputs[0]
+	for _, out := range element.Outputs {
+		if out.Type == "integer" {
+			output = out
+			break
+		}
+	}
+
+	cb := &valueChangeCallback{
+		id:     id,
+		output: output,
+		fn:     fn,
+	}
+	cb.value = cb.decode(currentSimData())
+	s.valueCallbacks = append(s.valueCallbacks, cb)
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// decode returns the current value of the control in buf.
+func (cb *valueChangeCallback) decode(buf *exportdataparser.DataBuffer) lua.LValue {
+	if buf == nil {
+		return lua.LNil
+	}
+	if cb.output.Type == "string" {
+		return lua.LString(buf.GetCStringValue(cb.id))
+	}
+	word := buf.GetValueAtAddress(cb.output.Address)
+	return lua.LNumber((word & cb.output.Mask) >> cb.output.ShiftBy)
+}
+
+// length returns the number of bytes in the export data that hold the value.
+func (cb *valueChangeCallback) length() uint16 {
+	if cb.output.Type == "string" {
+		return cb.output.MaxLength
+	}
+	return 2
+}
+
+// notifyValueChangeCallbacks calls the functions registered with
+// hub.onSimValueChanged for every control whose value has changed in buf.
+// Only values in words that are marked as dirty are decoded.
+// The caller must hold s.lock.
+func (s *script) notifyValueChangeCallbacks(buf *exportdataparser.DataBuffer, limit time.Duration) (incidents []string) {
+	if buf == nil {
+		return nil
+	}
+	for _, cb := range s.valueCallbacks {
+		if !buf.IsDirty(cb.output.Address, cb.length()) {
+			continue
+		}
+		newValue := cb.decode(buf)
+		oldValue := cb.value
+		if newValue == oldValue {
+			continue
+		}
+		cb.value = newValue
+
+		err := s.withTimeLimit(limit, func() error {
+			return s.L.CallByParam(lua.P{
+				Fn:      cb.fn,
+				NRet:    0,
+				Protect: true,
+			}, newValue, oldValue)
+		})
+		if _, ok := err.(timeLimitError); ok {
+			s.valueCallbacks = removeValueChangeCallback(s.valueCallbacks, cb)
+			incidents = append(incidents, fmt.Sprintf("value change callback %s for %s disabled: %v", callbackLocation(cb.fn), cb.id, err))
+		} else if err != nil {
+			logScriptError(s.path, "value change callback for "+cb.id+": ", err)
+		}
+	}
+	return incidents
+}
+
+// removeValueChangeCallback returns a copy of callbacks without cb.
+func removeValueChangeCallback(callbacks []*valueChangeCallback, cb *valueChangeCallback) []*valueChangeCallback {
+	remaining := make([]*valueChangeCallback, 0, len(callbacks))
+	for _, c := range callbacks {
+		if c != cb {
+			remaining = append(remaining, c)
+		}
+	}
+	return remaining
+}
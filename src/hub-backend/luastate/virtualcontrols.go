@@ -0,0 +1,374 @@
+package luastate
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+	"sync"
+
+	"dcs-bios.a10c.de/dcs-bios-hub/configstore"
+	"dcs-bios.a10c.de/dcs-bios-hub/controlreference"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Virtual controls are allocated in this address range of the export data.
+// The range is reserved for them, but it is not assumed to be free: addresses
+// used by a loaded module definition (of an aircraft or a plugin) are skipped.
+const (
+	virtualControlsStartAddress = 0xE000
+	virtualControlsEndAddress   = 0xF000 // exclusive
+)
+
+// defaultVirtualControlCategory is the category of virtual controls
+// in the control reference if the script does not specify one.
+const defaultVirtualControlCategory = "Virtual Controls"
+
+// virtualControlAllocation is the part of the export data that holds the value
+// of a virtual output. Allocations are stored in virtualcontrols.json, so a
+// virtual control keeps its address when the hub is restarted.
+type virtualControlAllocation struct {
+	Type     string `json:"type"`
+	Address  uint16 `json:"address"`
+	Mask     uint16 `json:"mask"`
+	ShiftBy  uint16 `json:"shift_by"`
+	MaxValue uint16 `json:"max_value"`
+	Length   uint16 `json:"max_length"`
+}
+
+// addUsedBits marks the bits used by a in used, which maps
+// the address of each 16-bit word to the bits in use.
+func (a virtualControlAllocation) addUsedBits(used map[uint16]uint16) {
+	if a.Type == "string" {
+		for addr := uint32(a.Address); addr < uint32(a.Address)+uint32(a.Length) && addr <= 0xFFFF; addr += 2 {
+			used[uint16(addr)] = 0xFFFF
+		}
+	} else {
+		used[a.Address] |= a.Mask
+	}
+}
+
+// overlaps returns true if a uses any of the bits marked in used.
+func (a virtualControlAllocation) overlaps(used map[uint16]uint16) bool {
+	mine := make(map[uint16]uint16)
+	a.addUsedBits(mine)
+	for addr, mask := range mine {
+		if used[addr]&mask != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleOutputBits returns the bits used by the outputs of the module
+// definitions in the control reference, excluding virtual controls.
+func moduleOutputBits() map[uint16]uint16 {
+	used := make(map[uint16]uint16)
+	if ControlReferenceStore == nil {
+		return used
+	}
+	for _, element := range ControlReferenceStore.GetAllIOElements() {
+		if element.Type == "virtual" {
+			continue
+		}
+		for _, output := range element.Outputs {
+			a := virtualControlAllocation{
+				Type:    output.Type,
+				Address: output.Address,
+				Mask:    output.Mask,
+				Length:  output.MaxLength,
+			}
+			if a.Type != "string" && a.Mask == 0 {
+				a.Mask = 0xFFFF
+			}
+			a.addUsedBits(used)
+		}
+	}
+	return used
+}
+
+// virtualControlDefinition is a virtual control as defined by one script.
+type virtualControlDefinition struct {
+	owner   *script
+	element controlreference.IOElement
+}
+
+// virtualControlsLock protects the variables below.
+// It may be acquired while holding the lock of a script.
+var virtualControlsLock sync.Mutex
+
+// virtualControlAllocations maps lower case identifiers to their allocation.
+// It is loaded from virtualcontrols.json when the first control is defined.
+var virtualControlAllocations map[string]virtualControlAllocation
+
+// virtualControls maps lower case identifiers to the definitions of each
+// script that defined the control. The last definition is the one in the
+// control reference; there is more than one while a script is being reloaded.
+var virtualControls = make(map[string][]virtualControlDefinition)
+
+// defineOutput(id, options)
+// declares a virtual output that is sent to the panels like an output exported
+// by DCS: World. options is a table with the fields type ("integer" or "string"),
+// max (for integers, default 1), max_length (for strings), description and category.
+// Returns a table describing the control in the format used by getControl.
+func (s *script) defineOutput(L *lua.LState) int {
+	id := checkVirtualControlIdentifier(L, 1)
+	opts := L.OptTable(2, L.NewTable())
+
+	typ := optString(opts, "type", "integer")
+	var maxValue, maxLength int
+	switch typ {
+	case "integer":
+		maxValue = optInt(opts, "max", 1)
+		if maxValue < 1 || maxValue > 0xFFFF {
+			L.ArgError(2, "max must be between 1 and 65535")
+		}
+	case "string":
+		maxLength = optInt(opts, "max_length", 0)
+		if maxLength < 1 || maxLength > virtualControlsEndAddress-virtualControlsStartAddress {
+			L.ArgError(2, "max_length must be a positive number")
+		}
+	default:
+		L.ArgError(2, `type must be "integer" or "string"`)
+	}
+
+	virtualControlsLock.Lock()
+	defer virtualControlsLock.Unlock()
+
+	element, err := s.virtualControlElement(id, opts)
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	alloc, err := allocateVirtualOutput(strings.ToLower(id), typ, uint16(maxValue), uint16(maxLength))
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	element.Outputs = []controlreference.Output{{
+		Address:     alloc.Address,
+		Mask:        alloc.Mask,
+		ShiftBy:     alloc.ShiftBy,
+		MaxValue:    alloc.MaxValue,
+		MaxLength:   alloc.Length,
+		Type:        alloc.Type,
+		Description: element.Description,
+	}}
+	s.setVirtualControl(element)
+
+	L.Push(toLuaValue(L, element))
+	return 1
+}
+
+// defineInput(id, options, fn)
+// declares a virtual input that can be used by panels like an input of an
+// aircraft module. options is a table with the fields interface (default
+// "set_state"), max (default 1), description and category.
+// If fn is given, it is called with the argument of every command for this
+// input, and the command is not passed on to input callbacks or DCS.
+// Returns a table describing the control in the format used by getControl.
+func (s *script) defineInput(L *lua.LState) int {
+	id := checkVirtualControlIdentifier(L, 1)
+	opts := L.OptTable(2, L.NewTable())
+	fn := L.OptFunction(3, nil)
+
+	virtualControlsLock.Lock()
+	defer virtualControlsLock.Unlock()
+
+	element, err := s.virtualControlElement(id, opts)
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	element.Inputs = []controlreference.Input{{
+		Interface:   optString(opts, "interface", "set_state"),
+		MaxValue:    optInt(opts, "max", 1),
+		Argument:    optString(opts, "argument", ""),
+		Description: element.Description,
+	}}
+	s.setVirtualControl(element)
+	if fn != nil {
+		s.virtualInputs[element.Name] = fn
+	}
+
+	L.Push(toLuaValue(L, element))
+	return 1
+}
+
+// checkVirtualControlIdentifier returns argument n, raising a Lua error
+// if it is not of the form "module/element".
+func checkVirtualControlIdentifier(L *lua.LState, n int) string {
+	id := L.CheckString(n)
+	parts := strings.Split(id, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(id, " \t\n") {
+		L.ArgError(n, `identifier must be of the form "MODULE/ELEMENT" and must not contain spaces`)
+	}
+	return id
+}
+
+// virtualControlElement returns the IOElement for a virtual control. If the
+// script has already defined the control, the existing element is returned so
+// inputs and outputs can be defined separately.
+// The caller must hold virtualControlsLock.
+func (s *script) virtualControlElement(id string, opts *lua.LTable) (controlreference.IOElement, error) {
+	key := strings.ToLower(id)
+	definitions := virtualControls[key]
+	if len(definitions) == 0 && ControlReferenceStore != nil && ControlReferenceStore.GetIOElementByIdentifier(id) != nil {
+		return controlreference.IOElement{}, fmt.Errorf("a control named %s already exists", id)
+	}
+
+	parts := strings.Split(id, "/")
+	element := controlreference.IOElement{
+		Module:   parts[0],
+		Name:     parts[1],
+		Type:     "virtual",
+		Inputs:   []controlreference.Input{},
+		Outputs:  []controlreference.Output{},
+		Category: defaultVirtualControlCategory,
+	}
+	for _, def := range definitions {
+		if def.owner == s {
+			element = def.element
+		} else if def.owner.path != s.path {
+			return controlreference.IOElement{}, fmt.Errorf("%s has already been defined by %s", id, def.owner.path)
+		}
+	}
+	element.Category = optString(opts, "category", element.Category)
+	element.Description = optString(opts, "description", element.Description)
+	return element, nil
+}
+
+// setVirtualControl stores the definition of a virtual control by this script
+// and adds it to the control reference.
+// The caller must hold virtualControlsLock.
+func (s *script) setVirtualControl(element controlreference.IOElement) {
+	key := strings.ToLower(element.Module + "/" + element.Name)
+	definitions := make([]virtualControlDefinition, 0, len(virtualControls[key])+1)
+	for _, def := range virtualControls[key] {
+		if def.owner != s {
+			definitions = append(definitions, def)
+		}
+	}
+	virtualControls[key] = append(definitions, virtualControlDefinition{owner: s, element: element})
+	if ControlReferenceStore != nil {
+		ControlReferenceStore.AddIOElement(element)
+	}
+}
+
+// removeVirtualControls removes the virtual controls defined by s from the
+// control reference. Their addresses stay allocated.
+func (s *script) removeVirtualControls() {
+	virtualControlsLock.Lock()
+	defer virtualControlsLock.Unlock()
+
+	for key, definitions := range virtualControls {
+		remaining := make([]virtualControlDefinition, 0, len(definitions))
+		var removed *controlreference.IOElement
+		for i, def := range definitions {
+			if def.owner == s {
+				removed = &definitions[i].element
+			} else {
+				remaining = append(remaining, def)
+			}
+		}
+		if removed == nil {
+			continue
+		}
+		if len(remaining) == 0 {
+			delete(virtualControls, key)
+			if ControlReferenceStore != nil {
+				ControlReferenceStore.RemoveIOElement(removed.Module, removed.Name)
+			}
+			continue
+		}
+		// another version of the script is still running
+		virtualControls[key] = remaining
+		if ControlReferenceStore != nil {
+			ControlReferenceStore.AddIOElement(remaining[len(remaining)-1].element)
+		}
+	}
+}
+
+// allocateVirtualOutput returns the allocation for the virtual output key.
+// An existing allocation is kept if the type and size have not changed and
+// no module definition that has been loaded since then uses its address.
+// The caller must hold virtualControlsLock.
+func allocateVirtualOutput(key string, typ string, maxValue uint16, maxLength uint16) (virtualControlAllocation, error) {
+	if virtualControlAllocations == nil {
+		virtualControlAllocations = make(map[string]virtualControlAllocation)
+		configstore.Load("virtualcontrols.json", &virtualControlAllocations)
+	}
+
+	alloc := virtualControlAllocation{
+		Type:     typ,
+		MaxValue: maxValue,
+		Length:   maxLength,
+	}
+	// bits that are used in each word of the reserved address range
+	used := moduleOutputBits()
+	if existing, ok := virtualControlAllocations[key]; ok {
+		if existing.Type == typ && existing.Length == maxLength && bits.Len16(existing.MaxValue) == bits.Len16(maxValue) && !existing.overlaps(used) {
+			existing.MaxValue = maxValue
+			virtualControlAllocations[key] = existing
+			return existing, nil
+		}
+		delete(virtualControlAllocations, key)
+	}
+
+	for _, a := range virtualControlAllocations {
+		a.addUsedBits(used)
+	}
+
+	found := false
+	if typ == "string" {
+		words := (maxLength + 1) / 2
+	findString:
+		for addr := uint32(virtualControlsStartAddress); addr+uint32(words)*2 <= virtualControlsEndAddress; addr += 2 {
+			for i := uint32(0); i < uint32(words); i++ {
+				if used[uint16(addr+i*2)] != 0 {
+					continue findString
+				}
+			}
+			alloc.Address = uint16(addr)
+			found = true
+			break
+		}
+	} else {
+		width := uint16(bits.Len16(maxValue))
+		fieldMask := uint16((uint32(1) << width) - 1)
+	findInteger:
+		for addr := uint32(virtualControlsStartAddress); addr < virtualControlsEndAddress; addr += 2 {
+			for shift := uint16(0); shift+width <= 16; shift++ {
+				if used[uint16(addr)]&(fieldMask<<shift) == 0 {
+					alloc.Address = uint16(addr)
+					alloc.Mask = fieldMask << shift
+					alloc.ShiftBy = shift
+					found = true
+					break findInteger
+				}
+			}
+		}
+	}
+	if !found {
+		return alloc, errors.New("the address range for virtual controls is full")
+	}
+
+	virtualControlAllocations[key] = alloc
+	if persistentState {
+		configstore.Store("virtualcontrols.json", virtualControlAllocations)
+	}
+	return alloc, nil
+}
+
+// optString returns the string field key of t, or def if it is not set.
+func optString(t *lua.LTable, key string, def string) string {
+	if v, ok := t.RawGetString(key).(lua.LString); ok {
+		return string(v)
+	}
+	return def
+}
+
+// optInt returns the number field key of t, or def if it is not set.
+func optInt(t *lua.LTable, key string, def int) int {
+	if v, ok := t.RawGetString(key).(lua.LNumber); ok {
+		return int(v)
+	}
+	return def
+}
@@ -0,0 +1,150 @@
+package luastate
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// scriptWatchInterval is the interval in which the modification
+// times of all script files are checked.
+const scriptWatchInterval = 500 * time.Millisecond
+
+// scriptReloadDebounce is the time a changed script has to remain
+// unchanged before it is reloaded, so a script is not reloaded while
+// an editor is still writing it.
+const scriptReloadDebounce = 1 * time.Second
+
+// RunScriptWatcher reloads hub scripts when the script file or a file it
+// loaded with dofile or loadfile changes. It returns when ctx is done.
+func RunScriptWatcher(ctx context.Context) {
+	ticker := time.NewTicker(scriptWatchInterval)
+	defer ticker.Stop()
+
+	// for each changed script, the most recently observed state
+	// of its files and the time it was first observed
+	type pendingChange struct {
+		files map[string]time.Time
+		since time.Time
+	}
+	pending := make(map[string]pendingChange)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		for path, loadedFiles := range watchedScripts() {
+			currentFiles := currentModTimes(loadedFiles)
+			if sameModTimes(loadedFiles, currentFiles) {
+				delete(pending, path)
+				continue
+			}
+			change, ok := pending[path]
+			if !ok || !sameModTimes(change.files, currentFiles) {
+				pending[path] = pendingChange{files: currentFiles, since: time.Now()}
+				continue
+			}
+			if time.Since(change.since) >= scriptReloadDebounce {
+				delete(pending, path)
+				hotReloadScript(path, currentFiles)
+			}
+		}
+	}
+}
+
+// watchedScripts returns the files of every enabled and active script
+// and their modification times at the time the script was loaded.
+func watchedScripts() map[string]map[string]time.Time {
+	luaLock.Lock()
+	defer luaLock.Unlock()
+
+	scripts := make(map[string]map[string]time.Time)
+	for _, entry := range scriptList {
+		if !entry.Enabled || entry.State == ScriptStateInactive {
+			continue
+		}
+		if s, ok := runningScripts[entry.Path]; ok {
+			scripts[entry.Path] = s.watchedFiles()
+		} else {
+			// the script could not be found, reload it when it is created
+			scripts[entry.Path] = map[string]time.Time{entry.Path: time.Time{}}
+		}
+	}
+	return scripts
+}
+
+// currentModTimes returns the current modification time of each file.
+// Files that do not exist have the zero time.
+func currentModTimes(files map[string]time.Time) map[string]time.Time {
+	current := make(map[string]time.Time, len(files))
+	for path := range files {
+		if stat, err := os.Stat(path); err == nil {
+			current[path] = stat.ModTime()
+		} else {
+			current[path] = time.Time{}
+		}
+	}
+	return current
+}
+
+func sameModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, modTime := range a {
+		if !modTime.Equal(b[path]) {
+			return false
+		}
+	}
+	return true
+}
+
+// hotReloadScript loads a script that has changed in a new Lua state.
+// If the new version fails to load while the previous version is running,
+// the previous version is kept. A previous version that holds a UDP port
+// or a shared memory area is stopped first, so the new version can
+// acquire them; it cannot be kept if the new version fails to load.
+func hotReloadScript(path string, changedFiles map[string]time.Time) {
+	logScriptMessage(path, ScriptLogLevelInfo, "file changed, reloading")
+
+	luaLock.Lock()
+	if s, ok := runningScripts[path]; ok && s.holdsExclusiveResources() {
+		logScriptMessage(path, ScriptLogLevelInfo, "stopping the previous version to release its sockets and shared memory areas")
+		stopScript(path)
+	}
+	luaLock.Unlock()
+
+	// load the script before acquiring luaLock,
+	// so other scripts are not blocked while it is executed
+	s, err := loadScript(path, ioutil.Discard)
+
+	luaLock.Lock()
+	defer luaLock.Unlock()
+	defer notifyScriptListSubscribers()
+
+	entry := findScriptListEntry(path)
+	if entry == nil || !entry.Enabled {
+		// the script has been removed or disabled in the meantime
+		if s != nil {
+			s.close()
+		}
+		return
+	}
+
+	previous, hasPrevious := runningScripts[path]
+	if err != nil && hasPrevious && entry.State == ScriptStateRunning {
+		if s != nil {
+			s.close()
+		}
+		previous.setWatchedFiles(changedFiles)
+		entry.Error = "reload failed, the previous version is still running: " + err.Error()
+		logScriptMessage(path, ScriptLogLevelInfo, "keeping the previous version")
+		return
+	}
+
+	setRunningScript(entry, s, err)
+}
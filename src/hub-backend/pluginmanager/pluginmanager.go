@@ -8,6 +8,7 @@
 package pluginmanager
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -27,6 +28,7 @@ import (
 
 	"dcs-bios.a10c.de/dcs-bios-hub/controlreference"
 	"dcs-bios.a10c.de/dcs-bios-hub/jsonapi"
+	"dcs-bios.a10c.de/dcs-bios-hub/luastate"
 )
 
 const PluginManagerRemoteName = "dcs_bios_plugin_manager_remote"
@@ -67,20 +69,20 @@ func NewPluginManager(checkoutPath string, jsonAPI *jsonapi.JsonApi, crs *contro
 	pm.stateLock.Unlock()
 
 	jsonAPI.RegisterType("install_plugin", InstallPluginRequest{})
-	jsonAPI.RegisterApiCall("install_plugin", pm.HandleInstallPluginRequest)
+	jsonAPI.RegisterApiCallWithTimeout("install_plugin", pm.HandleInstallPluginRequest, 0)
 
 	jsonAPI.RegisterType("remove_plugin", RemovePluginListRequest{})
 	jsonAPI.RegisterApiCall("remove_plugin", pm.HandleRemovePluginRequest)
 
 	jsonAPI.RegisterType("monitor_plugin_list", MonitorPluginListRequest{})
 	jsonAPI.RegisterType("plugin_list", PluginList(nil))
-	jsonAPI.RegisterApiCall("monitor_plugin_list", pm.HandleMonitorPluginListRequest)
+	jsonAPI.RegisterStreamingApiCall("monitor_plugin_list", pm.HandleMonitorPluginListRequest)
 
 	jsonAPI.RegisterType("check_for_plugin_updates", CheckForPluginUpdatesRequest{})
-	jsonAPI.RegisterApiCall("check_for_plugin_updates", pm.HandleCheckForPluginUpdatesRequest)
+	jsonAPI.RegisterApiCallWithTimeout("check_for_plugin_updates", pm.HandleCheckForPluginUpdatesRequest, 0)
 
 	jsonAPI.RegisterType("apply_plugin_updates", ApplyPluginUpdatesRequest{})
-	jsonAPI.RegisterApiCall("apply_plugin_updates", pm.HandleApplyPluginUpdateRequest)
+	jsonAPI.RegisterApiCallWithTimeout("apply_plugin_updates", pm.HandleApplyPluginUpdateRequest, 0)
 
 	pm.registerPluginCatalogApi()
 
@@ -104,30 +106,17 @@ type PluginState struct {
 	IsLoaded             bool     `json:"isLoaded"`      // true if the plugin was loaded correctly
 	LoadError            string   `json:"loadError"`     // if IsLoaded is false, this contains the error description
 	ModuleDefinitionName string   `json:"moduleDefinitionName"`
+	HubScripts           []string `json:"hubScripts"` // absolute paths of the hub scripts provided by the plugin
+	hubScripts           []luastate.PluginScript
 }
 
 type MonitorPluginListRequest struct {
 }
 type PluginList []PluginState
 
-func (pm *pluginManager) HandleMonitorPluginListRequest(req *MonitorPluginListRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+func (pm *pluginManager) HandleMonitorPluginListRequest(ctx context.Context, req *MonitorPluginListRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
 	subscription := make(chan []PluginState)
-	go func() {
-		defer close(responseCh)
-		for newState := range subscription {
-			select {
-			case responseCh <- PluginList(newState):
-			case _, ok := <-followupCh:
-				if !ok {
-					pm.stateLock.Lock()
-					defer pm.stateLock.Unlock()
-					delete(pm.stateSubscriptions, subscription)
-					return
-				}
-			}
-
-		}
-	}()
 
 	pm.stateLock.Lock()
 	pm.stateSubscriptions[subscription] = true
@@ -141,10 +130,26 @@ func (pm *pluginManager) HandleMonitorPluginListRequest(req *MonitorPluginListRe
 		stateCopy = append(stateCopy, *pm.state[name])
 	}
 	pm.stateLock.Unlock()
-	subscription <- stateCopy
 
-	<-followupCh // wait for connection to be closed
+	defer func() {
+		pm.stateLock.Lock()
+		delete(pm.stateSubscriptions, subscription)
+		pm.stateLock.Unlock()
+	}()
 
+	// send state updates until the connection is closed
+	for {
+		select {
+		case responseCh <- PluginList(stateCopy):
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case stateCopy = <-subscription:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
 type RemovePluginListRequest struct {
@@ -177,6 +182,7 @@ func (pm *pluginManager) HandleRemovePluginRequest(req *RemovePluginListRequest,
 	pm.notifyStateObservers()
 	pm.stateLock.Unlock()
 
+	luastate.RemovePluginScripts(req.LocalName)
 	err := os.RemoveAll(filepath.Join(pm.CheckoutPath, req.LocalName))
 
 	pm.stateLock.Lock()
@@ -257,6 +263,7 @@ func (pm *pluginManager) HandleInstallPluginRequest(req *InstallPluginRequest, r
 		CheckedOutTags:  make([]string, 0),
 		Tags:            make([]string, 0),
 		Branches:        make([]string, 0),
+		HubScripts:      make([]string, 0),
 	}
 	pm.notifyStateObservers()
 	pm.stateLock.Unlock()
@@ -291,6 +298,7 @@ func (pm *pluginManager) ReadSinglePluginStateFromDisk(localName string) (*Plugi
 		CheckedOutTags: make([]string, 0),
 		Tags:           make([]string, 0),
 		Branches:       make([]string, 0),
+		HubScripts:     make([]string, 0),
 	}
 
 	// determine remoteURL
@@ -360,9 +368,16 @@ func (pm *pluginManager) ReadSinglePluginStateFromDisk(localName string) (*Plugi
 		return nil
 	})
 
+	type hubScriptManifestEntry struct {
+		Path    string `json:"path"`    // relative to the plugin directory
+		Enabled *bool  `json:"enabled"` // whether the script is enabled when it is installed (default: true)
+		// the aircraft the script is activated for when it is installed (default: all)
+		Aircraft []string `json:"aircraft"`
+	}
 	type pluginManifest struct {
-		ManifestVersion      int    `json:"manifestVersion"`
-		ModuleDefinitionName string `json:"moduleDefinitionName"`
+		ManifestVersion      int                      `json:"manifestVersion"`
+		ModuleDefinitionName string                   `json:"moduleDefinitionName"`
+		HubScripts           []hubScriptManifestEntry `json:"hubScripts"`
 	}
 
 	// check for manifest
@@ -380,6 +395,20 @@ func (pm *pluginManager) ReadSinglePluginStateFromDisk(localName string) (*Plugi
 					if manifest.ModuleDefinitionName != "" {
 						state.ModuleDefinitionName = manifest.ModuleDefinitionName
 					}
+					pluginDir := filepath.Join(pm.CheckoutPath, localName)
+					for _, hs := range manifest.HubScripts {
+						scriptPath := filepath.Join(pluginDir, filepath.FromSlash(hs.Path))
+						if rel, err := filepath.Rel(pluginDir, scriptPath); err != nil || strings.HasPrefix(rel, "..") {
+							state.LoadError = "hub script outside of the plugin directory: " + hs.Path
+							continue
+						}
+						state.HubScripts = append(state.HubScripts, scriptPath)
+						state.hubScripts = append(state.hubScripts, luastate.PluginScript{
+							Path:     scriptPath,
+							Enabled:  hs.Enabled == nil || *hs.Enabled,
+							Aircraft: hs.Aircraft,
+						})
+					}
 				} else {
 					state.LoadError = "invalid manifest version"
 				}
@@ -397,9 +426,12 @@ func (pm *pluginManager) loadPlugin(state *PluginState) {
 		pm.controlReferenceStore.LoadFile(jsonPath)
 		pm.updateDcsLuaIndex()
 	}
+	// the module definition is loaded first, so the scripts can use its controls
+	luastate.SetPluginScripts(state.LocalName, state.hubScripts)
 }
 
 func (pm *pluginManager) unloadPlugin(state *PluginState) {
+	luastate.SetPluginScripts(state.LocalName, nil)
 	if state.ModuleDefinitionName != "" {
 		pm.controlReferenceStore.UnloadModuleDefinition(state.ModuleDefinitionName)
 	}
@@ -468,6 +500,7 @@ func (pm *pluginManager) HandleCheckForPluginUpdatesRequest(req *CheckForPluginU
 	wg.Add(numConcurrentFetches)
 	for i := 0; i < numConcurrentFetches; i++ {
 		go func() {
+			defer wg.Done()
 			for localName := range fetchJobChannel {
 				pm.stateLock.Lock()
 				state := pm.state[localName]
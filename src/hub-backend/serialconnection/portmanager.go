@@ -1,6 +1,7 @@
 package serialconnection
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -47,7 +48,7 @@ type PortManager struct {
 	portState            map[string]*PortState
 	portStateDirtyFlag   bool // portStateDirtyFlag is set whenever a port state changes and the UI has to be notified
 	portStateLock        sync.Mutex
-	stateSubscribers     map[chan PortStateSnapshot]struct{}
+	stateSubscribers     map[chan PortStateSnapshot]chan struct{} // maps each subscriber to a channel that is closed when it unsubscribes
 	stateSubscribersLock sync.Mutex
 	jsonAPI              *jsonapi.JsonApi
 }
@@ -56,7 +57,7 @@ func NewPortManager() *PortManager {
 	return &PortManager{
 		InputCommands:    make(chan InputCommand),
 		portState:        make(map[string]*PortState),
-		stateSubscribers: make(map[chan PortStateSnapshot]struct{}),
+		stateSubscribers: make(map[chan PortStateSnapshot]chan struct{}),
 	}
 }
 
@@ -75,18 +76,22 @@ func (p *PortManager) HandlePortPrefRequest(req *SetPortPrefRequest, responseCh
 
 type MonitorSerialPortRequest struct{}
 
-func (p *PortManager) HandleMonitorPortRequest(req *MonitorSerialPortRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+func (p *PortManager) HandleMonitorPortRequest(ctx context.Context, req *MonitorSerialPortRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+	defer close(responseCh)
 	updateChan := make(chan PortStateSnapshot)
 	p.SubscribePortStateUpdateChannel(updateChan)
 	defer p.UnsubscribePortStateUpdateChannel(updateChan)
 
 	for {
 		select {
-		case responseCh <- <-updateChan:
-		case _, ok := <-followupCh:
-			if !ok {
-				break // channel closed
+		case snapshot := <-updateChan:
+			select {
+			case responseCh <- snapshot:
+			case <-ctx.Done():
+				return
 			}
+		case <-ctx.Done():
+			return
 		}
 	}
 }
@@ -96,7 +101,7 @@ func (p *PortManager) SetupJSONApi(api *jsonapi.JsonApi) {
 	api.RegisterApiCall("set_port_pref", p.HandlePortPrefRequest)
 
 	api.RegisterType("monitor_serial_ports", MonitorSerialPortRequest{})
-	api.RegisterApiCall("monitor_serial_ports", p.HandleMonitorPortRequest)
+	api.RegisterStreamingApiCall("monitor_serial_ports", p.HandleMonitorPortRequest)
 	api.RegisterType("port_state_snapshot", PortStateSnapshot{})
 }
 
@@ -111,24 +116,35 @@ func (p *PortManager) SubscribePortStateUpdateChannel(ch chan PortStateSnapshot)
 		return // do not subscribe a channel twice
 	}
 
+	p.stateSubscribers[ch] = make(chan struct{})
 	p.sendPortStateCopyToChannel(ch)
-	p.stateSubscribers[ch] = struct{}{}
 }
 
+// sendPortStateCopyToChannel sends a copy of the current port state to a subscriber
+// without blocking the caller. The caller must hold p.portStateLock and p.stateSubscribersLock.
 func (p *PortManager) sendPortStateCopyToChannel(ch chan PortStateSnapshot) {
 	portStateCopy := make(map[string]PortState)
 	for k, v := range p.portState {
 		portStateCopy[k] = *v
 	}
-	go func() { ch <- portStateCopy }()
+	unsubscribed := p.stateSubscribers[ch]
+	go func() {
+		select {
+		case ch <- portStateCopy:
+		case <-unsubscribed:
+		}
+	}()
 }
 
-// UnsubscribePortUpdateChannel unsubscribes a channel from receiving new PortStates and closes the channel.
+// UnsubscribePortUpdateChannel unsubscribes a channel from receiving new PortStates.
+// Pending sends to the channel are abandoned.
 func (p *PortManager) UnsubscribePortStateUpdateChannel(ch chan PortStateSnapshot) {
 	p.stateSubscribersLock.Lock()
 	defer p.stateSubscribersLock.Unlock()
-	delete(p.stateSubscribers, ch)
-	close(ch)
+	if unsubscribed, ok := p.stateSubscribers[ch]; ok {
+		close(unsubscribed)
+		delete(p.stateSubscribers, ch)
+	}
 }
 
 func (p *PortManager) SetPortPreference(portName string, pref PortPreference) {
@@ -240,24 +256,44 @@ func (p *PortManager) updatePortState() {
 	}
 }
 
-func (p *PortManager) Run() {
+// Run loads the port configuration and connects to and disconnects from
+// serial ports until ctx is cancelled. Before it returns, all ports are
+// closed and the configuration is written to disk.
+func (p *PortManager) Run(ctx context.Context) {
 	// load configuration
 	initialPrefs := comportsJsonConfigFile{}
 	configstore.Load("comports.json", &initialPrefs)
+	p.portStateLock.Lock()
 	for _, portName := range initialPrefs.AutoConnect {
 		portState := p.getPortState(portName)
 		portState.AutoConnect = true
 		portState.ShouldBeConnected = true
 	}
+	p.portStateLock.Unlock()
 
 	for {
 		select {
 		case <-time.After(200 * time.Millisecond):
+		case <-ctx.Done():
+			p.shutdown()
+			return
 		}
 		p.updatePortState()
 	}
 }
 
+// shutdown closes all serial connections and persists the port configuration.
+func (p *PortManager) shutdown() {
+	p.portStateLock.Lock()
+	defer p.portStateLock.Unlock()
+	for _, portState := range p.portState {
+		if portState.serialConnection != nil {
+			portState.serialConnection.Close()
+		}
+	}
+	p.persistConfig()
+}
+
 func (p *PortManager) notifyPortState() {
 	p.stateSubscribersLock.Lock()
 	defer p.stateSubscribersLock.Unlock()
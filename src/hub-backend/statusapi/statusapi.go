@@ -4,6 +4,7 @@
 package statusapi
 
 import (
+	"context"
 	"sync"
 
 	"dcs-bios.a10c.de/dcs-bios-hub/jsonapi"
@@ -17,6 +18,10 @@ type StatusInfo struct {
 	IsLuaConsoleEnabled            bool   `json:"isLuaConsoleEnabled"`
 	IsExternalNetworkAccessEnabled bool   `json:"isExternalNetworkAccessEnabled"`
 	UnitType                       string `json:"unittype"`
+	// reported by the Lua Console hook while it is connected
+	DcsVersion      string   `json:"dcsVersion"`
+	Mission         string   `json:"mission"`
+	LuaEnvironments []string `json:"luaEnvironments"`
 }
 
 var currentStatus StatusInfo
@@ -26,7 +31,7 @@ var statusChannels map[chan StatusInfo]struct{} = make(map[chan StatusInfo]struc
 
 func RegisterApiCalls(jsonAPI *jsonapi.JsonApi) {
 	jsonAPI.RegisterType("get_status_updates", GetStatusUpdatesRequest{})
-	jsonAPI.RegisterApiCall("get_status_updates", HandleGetStatusUpdatesRequest)
+	jsonAPI.RegisterStreamingApiCall("get_status_updates", HandleGetStatusUpdatesRequest)
 	jsonAPI.RegisterType("status_update", StatusInfo{})
 }
 
@@ -43,25 +48,46 @@ func WithStatusInfoDo(mutator func(status *StatusInfo)) {
 
 type GetStatusUpdatesRequest struct{}
 
-func HandleGetStatusUpdatesRequest(req *GetStatusUpdatesRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
+func HandleGetStatusUpdatesRequest(ctx context.Context, req *GetStatusUpdatesRequest, responseCh chan<- interface{}, followupCh <-chan interface{}) {
 	defer close(responseCh)
 
 	statusChannel := make(chan StatusInfo)
 
 	statusLock.Lock()
 	statusChannels[statusChannel] = struct{}{}
-	responseCh <- currentStatus
+	initialStatus := currentStatus
 	statusLock.Unlock()
 
+	defer func() {
+		// WithStatusInfoDo() may be blocked sending to statusChannel
+		// while holding the statusLock, so keep draining it until
+		// we have unsubscribed.
+		go func() {
+			for range statusChannel {
+			}
+		}()
+		statusLock.Lock()
+		delete(statusChannels, statusChannel)
+		statusLock.Unlock()
+		close(statusChannel)
+	}()
+
+	select {
+	case responseCh <- initialStatus:
+	case <-ctx.Done():
+		return
+	}
+
 	for {
 		select {
 		case newStatus := <-statusChannel:
-			responseCh <- newStatus
-		case <-followupCh:
+			select {
+			case responseCh <- newStatus:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
 			// when the connection is closed, unsubscribe
-			statusLock.Lock()
-			delete(statusChannels, statusChannel)
-			statusLock.Unlock()
 			return
 		}
 	}
@@ -0,0 +1,73 @@
+package statusapi
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"dcs-bios.a10c.de/dcs-bios-hub/internal/testutil"
+	"dcs-bios.a10c.de/dcs-bios-hub/jsonapi"
+)
+
+func TestCancelledStatusUpdatesRequestUnsubscribes(t *testing.T) {
+	base := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	responseCh := make(chan interface{})
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		HandleGetStatusUpdatesRequest(ctx, &GetStatusUpdatesRequest{}, responseCh, nil)
+	}()
+
+	<-responseCh // initial status
+	go WithStatusInfoDo(func(status *StatusInfo) {
+		status.IsDcsConnected = true
+	})
+	if status := (<-responseCh).(StatusInfo); !status.IsDcsConnected {
+		t.Errorf("status update was not delivered")
+	}
+
+	// the next update is not read, so the handler is blocked
+	// sending it when the request is cancelled
+	updateDone := make(chan struct{})
+	go func() {
+		defer close(updateDone)
+		WithStatusInfoDo(func(status *StatusInfo) {
+			status.IsDcsConnected = false
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	for range responseCh {
+	}
+	<-handlerDone
+	<-updateDone
+	testutil.WaitForGoroutines(t, base)
+
+	statusLock.Lock()
+	subscribers := len(statusChannels)
+	statusLock.Unlock()
+	if subscribers != 0 {
+		t.Errorf("%d status channels are still registered", subscribers)
+	}
+}
+
+func TestCancellingApiContextStopsStatusUpdates(t *testing.T) {
+	base := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	api := jsonapi.NewJsonApi(ctx)
+	RegisterApiCalls(api)
+
+	followup := make(chan []byte)
+	responses, err := api.HandleApiCall([]byte(`{"datatype": "get_status_updates", "data": {}}`), followup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-responses
+	cancel()
+	for range responses {
+	}
+	close(followup)
+	testutil.WaitForGoroutines(t, base)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"dcs-bios.a10c.de/dcs-bios-hub/configstore"
+	"dcs-bios.a10c.de/dcs-bios-hub/controlreference"
+	"dcs-bios.a10c.de/dcs-bios-hub/jsonapi"
+	"dcs-bios.a10c.de/dcs-bios-hub/luastate"
+)
+
+// runTestCommand implements the "test" subcommand, which runs the Lua tests
+// of a hub script without DCS: World or any panels:
+//
+//	dcs-bios-hub test [-junit results.xml] [-json] [-modules dir] script.lua tests.lua
+//
+// It returns the exit code: 0 if all tests passed, 1 if a test failed
+// and 2 if the arguments are invalid.
+func runTestCommand(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	junitPath := flags.String("junit", "", "Write the results as JUnit XML to this file (- for standard output).")
+	jsonOutput := flags.Bool("json", false, "Write the results as JSON to standard output.")
+	modulesDir := flags.String("modules", "", "Load the module definitions (*.json) in this directory in addition to those of the installed plugins.")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: dcs-bios-hub test [flags] script.lua tests.lua")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+
+	// the control reference provides the addresses of the controls
+	// that the script and the tests refer to
+	cref := controlreference.NewControlReferenceStore(jsonapi.NewJsonApi(context.Background()))
+	if executableFilePath, err := os.Executable(); err == nil {
+		executableDir := filepath.Dir(executableFilePath)
+		cref.LoadFile(filepath.Join(executableDir, "control-reference-json", "MetadataStart.json"))
+		cref.LoadFile(filepath.Join(executableDir, "control-reference-json", "MetadataEnd.json"))
+	}
+	moduleDefinitions, _ := filepath.Glob(filepath.Join(configstore.GetPluginDir(), "*", "*.json"))
+	if *modulesDir != "" {
+		more, _ := filepath.Glob(filepath.Join(*modulesDir, "*.json"))
+		moduleDefinitions = append(moduleDefinitions, more...)
+	}
+	for _, path := range moduleDefinitions {
+		if filepath.Base(path) != "dcs-bios-plugin-manifest.json" {
+			cref.LoadFile(path)
+		}
+	}
+
+	luastate.SetCallbackTimeLimit(*luaCallbackTimeLimit)
+	luastate.SetCommandQueueSize(*luaCommandQueueSize)
+	luastate.ControlReferenceStore = cref
+	results := luastate.RunScriptTests(flags.Arg(0), flags.Arg(1))
+
+	if *junitPath != "" {
+		if err := writeJUnitXML(&results, *junitPath); err != nil {
+			fmt.Fprintf(os.Stderr, "could not write JUnit XML: %v\n", err)
+		}
+	}
+	if *jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(results)
+	} else if *junitPath != "-" {
+		printTestResults(&results)
+	}
+
+	if results.Failed() {
+		return 1
+	}
+	return 0
+}
+
+func writeJUnitXML(results *luastate.ScriptTestResults, path string) error {
+	if path == "-" {
+		return results.WriteJUnitXML(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := results.WriteJUnitXML(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func printTestResults(results *luastate.ScriptTestResults) {
+	if results.Error != "" {
+		fmt.Printf("could not load %s: %s\n", results.Tests, results.Error)
+		return
+	}
+	failed := 0
+	for _, c := range results.Cases {
+		if c.Passed {
+			fmt.Printf("PASS %s (%.3fs)\n", c.Name, c.Duration)
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL %s (%.3fs)\n    %s\n", c.Name, c.Duration, c.Failure)
+		for _, line := range c.Output {
+			fmt.Printf("    | %s\n", line)
+		}
+	}
+	fmt.Printf("%d passed, %d failed\n", len(results.Cases)-failed, failed)
+}
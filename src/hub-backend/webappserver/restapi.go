@@ -0,0 +1,201 @@
+package webappserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"dcs-bios.a10c.de/dcs-bios-hub/gui"
+	"dcs-bios.a10c.de/dcs-bios-hub/jsonapi"
+)
+
+// restApiPrefix is the path under which every registered API call
+// is available as POST /api/v1/<msgtype>.
+const restApiPrefix = "/api/v1/"
+
+// restApiHandler maps POST /api/v1/<msgtype> to the JSON API call <msgtype>.
+// The request body is the data of the initial message (an empty body is
+// treated as {}).
+//
+// Finite API calls are answered with a JSON array containing every response
+// message envelope. If one of them is an ErrorResult, its Code (or 500)
+// is used as the HTTP status code.
+//
+// Streaming API calls are answered with Server-Sent Events, one event
+// per response message, until the client disconnects.
+func restApiHandler(w http.ResponseWriter, r *http.Request) {
+	if !gui.IsExternalNetworkAccessEnabled() && !isLocalRequest(r.RemoteAddr) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden. Enable external network access through the system tray icon to allow DCS-BIOS to be accessed over the network."))
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "405 - only POST requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	msgtype := strings.TrimPrefix(r.URL.Path, restApiPrefix)
+	if !JsonApi.HasApiCall(msgtype) {
+		http.Error(w, "404 - unknown API call: "+msgtype, http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not read request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		body = []byte("{}")
+	}
+	if !json.Valid(body) {
+		http.Error(w, "could not parse JSON request", http.StatusBadRequest)
+		return
+	}
+	envelopeJson, err := json.Marshal(jsonapi.JsonMessageEnvelope{
+		DataType: msgtype,
+		Data:     json.RawMessage(body),
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not encode request: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	followupChan := make(chan []byte)
+	responseChan, err := JsonApi.HandleRemoteApiCall(r.RemoteAddr, envelopeJson, followupChan)
+	if err != nil {
+		close(followupChan)
+		http.Error(w, fmt.Sprintf("could not handle request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if JsonApi.IsStreamingApiCall(msgtype) {
+		serveEventStream(w, r, responseChan, followupChan)
+		return
+	}
+
+	serveResponseArray(w, r, responseChan, followupChan)
+}
+
+// serveResponseArray collects all responses of a finite API call
+// and writes them as a JSON array. If the client disconnects first,
+// the API call is cancelled.
+func serveResponseArray(w http.ResponseWriter, r *http.Request, responseChan chan jsonapi.ApiResponse, followupChan chan []byte) {
+	statusCode := http.StatusOK
+	responses := make([]json.RawMessage, 0)
+	for {
+		var resp jsonapi.ApiResponse
+		var ok bool
+		select {
+		case resp, ok = <-responseChan:
+		case <-r.Context().Done():
+			close(followupChan)
+			// let the handler function finish without blocking on its response channel
+			go func() {
+				for range responseChan {
+				}
+			}()
+			return
+		}
+		if !ok {
+			break
+		}
+		data := resp.Data
+		if !resp.IsUTF8 {
+			data, _ = json.Marshal(jsonapi.JsonMessageEnvelope{
+				DataType: "binary",
+				Data:     base64.StdEncoding.EncodeToString(resp.Data),
+			})
+		} else if code, isError := errorStatusCode(resp.Data); isError && statusCode == http.StatusOK {
+			statusCode = code
+		}
+		responses = append(responses, json.RawMessage(data))
+	}
+	close(followupChan)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(responses)
+}
+
+// serveEventStream sends every response of a streaming API call
+// as a Server-Sent Event until the client disconnects.
+func serveEventStream(w http.ResponseWriter, r *http.Request, responseChan chan jsonapi.ApiResponse, followupChan chan []byte) {
+	defer func() {
+		close(followupChan)
+		// let the handler function finish without blocking on its response channel
+		go func() {
+			for range responseChan {
+			}
+		}()
+	}()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported by this connection", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case resp, ok := <-responseChan:
+			if !ok {
+				return
+			}
+			var err error
+			if resp.IsUTF8 {
+				var envelope jsonapi.JsonMessageEnvelope
+				json.Unmarshal(resp.Data, &envelope)
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", envelope.DataType, resp.Data)
+			} else {
+				_, err = fmt.Fprintf(w, "event: binary\ndata: %s\n\n", base64.StdEncoding.EncodeToString(resp.Data))
+			}
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// schemaHandler serves the JSON Schema description of the JSON API.
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	if !gui.IsExternalNetworkAccessEnabled() && !isLocalRequest(r.RemoteAddr) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Forbidden. Enable external network access through the system tray icon to allow DCS-BIOS to be accessed over the network."))
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/schema+json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	enc.Encode(JsonApi.Describe())
+}
+
+// errorStatusCode checks whether the JSON envelope contains an ErrorResult
+// and returns the HTTP status code that should be used for it.
+func errorStatusCode(envelopeJson []byte) (statusCode int, isError bool) {
+	var errorResult jsonapi.ErrorResult
+	envelope := jsonapi.JsonMessageEnvelope{Data: &errorResult}
+	if err := json.Unmarshal(envelopeJson, &envelope); err != nil || envelope.DataType != "error" {
+		return 0, false
+	}
+	if errorResult.Code == 0 {
+		return http.StatusInternalServerError, true
+	}
+	return errorResult.Code, true
+}
@@ -38,6 +38,8 @@ func AddHandler(appPath string) {
 	// add handler
 	http.Handle("/app/", http.HandlerFunc(requestHandler))
 	http.Handle("/api/postjson", http.HandlerFunc(requestHandler))
+	http.Handle(restApiPrefix, http.HandlerFunc(restApiHandler))
+	http.Handle("/api/schema.json", http.HandlerFunc(schemaHandler))
 }
 
 func isLocalRequest(remoteAddr string) bool {
@@ -70,10 +72,11 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			fmt.Fprintf(w, "could not parse JSON request: %v", err)
+			return
 		}
 		followupChan := make(chan []byte)
 		defer close(followupChan)
-		responseChan, err := JsonApi.HandleApiCall(request, followupChan)
+		responseChan, err := JsonApi.HandleRemoteApiCall(r.RemoteAddr, request, followupChan)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "internal error while handling request: %v", err)
@@ -0,0 +1,224 @@
+package websocketapi
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// A multiplexed websocket (/api/websocket/multiplex) carries any number of
+// concurrent API calls. Every text message in both directions is a
+// multiplexedMessage whose ID identifies the API call it belongs to.
+// The IDs are chosen by the client and must be unique within the session.
+//
+// Client to server:
+//
+//	{"id": "1", "type": "call", "message": {"datatype": "...", "data": ...}}  starts an API call
+//	{"id": "1", "type": "followup", "message": {...}}                          sends a followup message
+//	{"id": "1", "type": "cancel"}                                              closes the followup channel
+//
+// An id can be used for a new API call once the "end" message of the
+// previous call with that id has been received.
+//
+// Server to client:
+//
+//	{"id": "1", "type": "response", "message": {...}}  a response message
+//	{"id": "1", "type": "binary", "binary": "<base64>"} a binary response message
+//	{"id": "1", "type": "end"}                          the API call has finished
+//	{"id": "1", "type": "error", "error": "..."}        the message could not be processed
+const (
+	muxTypeCall     = "call"
+	muxTypeFollowup = "followup"
+	muxTypeCancel   = "cancel"
+	muxTypeResponse = "response"
+	muxTypeBinary   = "binary"
+	muxTypeEnd      = "end"
+	muxTypeError    = "error"
+)
+
+// muxFollowupQueueSize is the number of followup messages that can be
+// queued for a single API call before further messages are rejected.
+const muxFollowupQueueSize = 64
+
+type multiplexedMessage struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Binary  []byte          `json:"binary,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+type muxSession struct {
+	conn       *websocket.Conn
+	remoteAddr string
+	writeLock  sync.Mutex
+	calls      map[string]*muxCall // active calls, until their "end" message is sent
+	callsLock  sync.Mutex
+}
+
+type muxCall struct {
+	queue     chan []byte // followup message queue
+	cancelled bool        // queue has been closed
+}
+
+// closeQueue closes the followup message queue if it is still open.
+// The caller must hold callsLock.
+func (c *muxCall) closeQueue() {
+	if !c.cancelled {
+		close(c.queue)
+		c.cancelled = true
+	}
+}
+
+func (s *muxSession) send(msg multiplexedMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("websocket api: could not encode multiplexed message: %s\n", err)
+		return
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (s *muxSession) sendError(id string, message string) {
+	s.send(multiplexedMessage{ID: id, Type: muxTypeError, Error: message})
+}
+
+// startCall starts a new API call and forwards its responses
+// to the websocket until the response channel is closed.
+func (s *muxSession) startCall(id string, envelopeJson []byte) {
+	s.callsLock.Lock()
+	if _, exists := s.calls[id]; exists {
+		s.callsLock.Unlock()
+		s.sendError(id, "an API call with this id is already active")
+		return
+	}
+
+	followupJson := make(chan []byte)
+	responses, callError := JsonApi.HandleRemoteApiCall(s.remoteAddr, envelopeJson, followupJson)
+	if callError != nil {
+		s.callsLock.Unlock()
+		close(followupJson)
+		s.sendError(id, callError.Error())
+		return
+	}
+	queue := make(chan []byte, muxFollowupQueueSize)
+	call := &muxCall{queue: queue}
+	s.calls[id] = call
+	s.callsLock.Unlock()
+
+	// pass queued followup messages on to the API call,
+	// so a handler that does not read them cannot block the session
+	go func() {
+		for msg := range queue {
+			followupJson <- msg
+		}
+		close(followupJson)
+	}()
+
+	go func() {
+		for resp := range responses {
+			if resp.IsUTF8 {
+				s.send(multiplexedMessage{ID: id, Type: muxTypeResponse, Message: json.RawMessage(resp.Data)})
+			} else {
+				s.send(multiplexedMessage{ID: id, Type: muxTypeBinary, Binary: resp.Data})
+			}
+		}
+		// the id stays reserved until now, even if the call has been
+		// cancelled, so it cannot be reused before "end" is sent
+		s.callsLock.Lock()
+		call.closeQueue()
+		delete(s.calls, id)
+		s.callsLock.Unlock()
+		s.send(multiplexedMessage{ID: id, Type: muxTypeEnd})
+	}()
+}
+
+func (s *muxSession) followup(id string, envelopeJson []byte) {
+	s.callsLock.Lock()
+	defer s.callsLock.Unlock()
+	call, ok := s.calls[id]
+	if !ok || call.cancelled {
+		go s.sendError(id, "no active API call with this id")
+		return
+	}
+	select {
+	case call.queue <- envelopeJson:
+	default:
+		go s.sendError(id, "followup message queue is full")
+	}
+}
+
+// cancelCall closes the followup channel of an API call.
+// It is safe to call this more than once for the same id.
+func (s *muxSession) cancelCall(id string) {
+	s.callsLock.Lock()
+	defer s.callsLock.Unlock()
+	if call, ok := s.calls[id]; ok {
+		call.closeQueue()
+	}
+}
+
+func (s *muxSession) cancelAllCalls() {
+	s.callsLock.Lock()
+	defer s.callsLock.Unlock()
+	for _, call := range s.calls {
+		call.closeQueue()
+	}
+}
+
+func multiplexedWsHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("failed to upgrade websocket request: %s\n", err)
+		return
+	}
+	if JsonApi == nil {
+		log.Printf("websocket api: JsonApi instance not set\n")
+		conn.Close()
+		return
+	}
+
+	session := &muxSession{
+		conn:       conn,
+		remoteAddr: r.RemoteAddr,
+		calls:      make(map[string]*muxCall),
+	}
+
+	go func() {
+		defer conn.Close()
+		defer session.cancelAllCalls()
+		for {
+			msgType, data, err := conn.ReadMessage()
+			if err != nil {
+				// WebSocket was closed
+				return
+			}
+			if msgType != websocket.TextMessage {
+				session.sendError("", "multiplexed websockets only accept text messages")
+				continue
+			}
+
+			var msg multiplexedMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				session.sendError("", "could not decode multiplexed message: "+err.Error())
+				continue
+			}
+
+			switch msg.Type {
+			case muxTypeCall:
+				session.startCall(msg.ID, msg.Message)
+			case muxTypeFollowup:
+				session.followup(msg.ID, msg.Message)
+			case muxTypeCancel:
+				session.cancelCall(msg.ID)
+			default:
+				session.sendError(msg.ID, "unknown multiplexed message type: "+msg.Type)
+			}
+		}
+	}()
+}
@@ -2,6 +2,10 @@
 The websocketapi package provides a WebSocket API to watch
 the hub configuration and the data exported from the simulator.
 
+A websocket connected to /api/websocket serves exactly one API call,
+which is determined by the first message. A websocket connected to
+/api/websocket/multiplex can carry many concurrent API calls.
+
 Work in progress.
 */
 package websocketapi
@@ -43,9 +47,11 @@ type WebSocketCommand interface {
 
 var JsonApi *jsonapi.JsonApi
 
-// AddHandler adds a handler for the request path /hubapi/websocket to the default net.http ServeMux
+// AddHandler adds handlers for the request paths /api/websocket and
+// /api/websocket/multiplex to the default net.http ServeMux
 func AddHandler() {
 	http.HandleFunc("/api/websocket", wsHandler)
+	http.HandleFunc("/api/websocket/multiplex", multiplexedWsHandler)
 }
 
 type SetSerialPortStateMessage struct {
@@ -75,7 +81,7 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	followupJson := make(chan []byte)
-	responses, callError := JsonApi.HandleApiCall(wsData, followupJson)
+	responses, callError := JsonApi.HandleRemoteApiCall(r.RemoteAddr, wsData, followupJson)
 	if callError != nil {
 		fmt.Printf("api call error: %s\n", callError)
 		return
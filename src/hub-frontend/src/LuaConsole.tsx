@@ -5,11 +5,29 @@ import 'codemirror/mode/javascript/javascript'
 
 import React from 'react';
 import { Controlled as CodeMirror } from 'react-codemirror2';
-import { getApiConnection } from './ApiConnection';
+import { apiPost, getApiConnection } from './ApiConnection';
 import { LuaConsoleStatus } from './Status'
 
+// In the "hub" environments, top-level local variables are kept between
+// snippets with the same session id, so every browser tab gets its own session.
+const sessionId = Date.now().toString(36) + Math.random().toString(36).substring(2)
+
+type LuaEnvironment = {
+    name: string
+    description: string
+    available: boolean
+}
+
+// used until the list of environments has been received from the hub
+const defaultEnvironments: LuaEnvironment[] = ["hub", "mission", "export", "gui"].map(name => ({
+    name: name,
+    description: "",
+    available: true
+}))
+
 type LuaSnippetState = {
     luaEnvironment: string
+    environments: LuaEnvironment[]
     code: string
     responseStatus: string
     responseText: string
@@ -21,6 +39,7 @@ class LuaSnippet extends React.Component<{}, LuaSnippetState> {
         super(props)
         this.state = {
             luaEnvironment: "hub",
+            environments: defaultEnvironments,
             code: "",
             responseStatus: "",
             responseText: "",
@@ -28,6 +47,23 @@ class LuaSnippet extends React.Component<{}, LuaSnippetState> {
         }
     }
 
+    componentDidMount() {
+        this.loadEnvironments()
+    }
+
+    // the list changes when hub scripts are started or stopped and when
+    // a mission is started in DCS, so it is reloaded whenever the dropdown is opened
+    loadEnvironments = () => {
+        apiPost({
+            datatype: "get_lua_environments",
+            data: {}
+        }).then((msg: any) => {
+            if (msg.datatype === "lua_environments") {
+                this.setState({ environments: msg.data.environments })
+            }
+        }).catch(() => {})
+    }
+
     onKeyPress = (src: any, event:any) => {
         if (event.ctrlKey && event.keyCode === 13) {
             this.executeSnippet()
@@ -45,7 +81,8 @@ class LuaSnippet extends React.Component<{}, LuaSnippetState> {
                 datatype:"execute_lua_snippet",
                 data: {
                     luaEnvironment: this.state.luaEnvironment,
-                    luaCode: this.state.code
+                    luaCode: this.state.code,
+                    sessionId: sessionId
                 }
             }))
         }
@@ -74,11 +111,12 @@ class LuaSnippet extends React.Component<{}, LuaSnippetState> {
             <div>
                 <LuaConsoleStatus/>
 
-                <b>Lua Environment:</b> <select value={this.state.luaEnvironment} onChange={(e) => {this.setState({ luaEnvironment: e.target.value });}}>
-                    <option value="hub">hub</option>
-                    <option value="mission">mission</option>
-                    <option value="export">export</option>
-                    <option value="gui">gui</option>
+                <b>Lua Environment:</b> <select value={this.state.luaEnvironment} onFocus={this.loadEnvironments} onChange={(e) => {this.setState({ luaEnvironment: e.target.value });}}>
+                    {this.state.environments.map(env =>
+                        <option key={env.name} value={env.name} title={env.description}>{env.name}{env.available ? "" : " (not available)"}</option>
+                    )}
+                    {this.state.environments.some(env => env.name === this.state.luaEnvironment) ? null :
+                        <option value={this.state.luaEnvironment}>{this.state.luaEnvironment} (not available)</option>}
                     </select> 
                 <br/>
                 <CodeMirror